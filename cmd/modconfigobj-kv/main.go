@@ -2,63 +2,262 @@ package main
 
 import (
 	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/christian-blades-cb/modconfigobj"
 )
 
 func main() {
-	flag.Parse()
-	filename := flag.Arg(0)
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("modconfigobj-kv", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	format := flags.String("format", "kv", "output format: kv or json")
+	nested := flags.Bool("nested", false, "with -format json, emit sections as nested objects")
+	get := flags.String("get", "", "print only the value at the given dotted path (e.g. section.sub.key)")
+	set := flags.String("set", "", "rewrite the file in place, setting a dotted path to a value (e.g. section.key=value)")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	filename := flags.Arg(0)
+
+	var output func(io.Writer, *modconfigobj.Lexer) error
+	switch {
+	case *format == "kv":
+		output = printKVs
+	case *format == "json" && *nested:
+		output = printNestedJSON
+	case *format == "json":
+		output = printJSON
+	default:
+		fmt.Fprintf(stderr, "unknown format %q\n", *format)
+		return 1
+	}
 
 	if filename == "" {
-		fmt.Println("must supply filename")
-		os.Exit(1)
+		fmt.Fprintln(stderr, "must supply filename")
+		return 1
+	}
+
+	if *set != "" {
+		if err := setInFile(filename, *set); err != nil {
+			fmt.Fprintln(stderr, err)
+			return 2
+		}
+		return 0
 	}
 
 	fd, err := os.Open(filename)
 	if err != nil {
-		panic(err)
+		fmt.Fprintln(stderr, err)
+		return 1
 	}
 	defer fd.Close()
 
-	buf := bufio.NewReader(fd)
-	lex := modconfigobj.NewLexer(buf)
+	input, err := decompress(fd)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
 
-	printKVs(lex)
+	lex := modconfigobj.NewLexerFromReader(input)
+	lex.TrimValues = true
+	lex.Filename = filename
+
+	if *get != "" {
+		value, found, err := getValue(lex, *get)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 2
+		}
+		if !found {
+			fmt.Fprintf(stderr, "%s not found\n", *get)
+			return 3
+		}
+
+		fmt.Fprintln(stdout, value)
+		return 0
+	}
+
+	if err := output(stdout, lex); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+
+	return 0
 }
 
-func printKVs(lex *modconfigobj.Lexer) {
-	sectionStack := []string{}
+// decompress transparently gunzips r if it begins with the gzip magic
+// bytes, otherwise r is read as-is
+func decompress(r io.Reader) (io.Reader, error) {
+	buf := bufio.NewReader(r)
+
+	magic, err := buf.Peek(2)
+	if err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		return gzip.NewReader(buf)
+	}
+
+	return buf, nil
+}
+
+func printKVs(w io.Writer, lex *modconfigobj.Lexer) error {
+	return walkKVs(lex, func(path []string, value string) error {
+		_, err := fmt.Fprintf(w, "%s=%s\n", strings.Join(path, "."), value)
+		return err
+	})
+}
+
+func printJSON(w io.Writer, lex *modconfigobj.Lexer) error {
+	kvs := map[string]string{}
+	err := walkKVs(lex, func(path []string, value string) error {
+		kvs[strings.Join(path, ".")] = value
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return json.NewEncoder(w).Encode(kvs)
+}
+
+func printNestedJSON(w io.Writer, lex *modconfigobj.Lexer) error {
+	root := map[string]interface{}{}
+	err := walkKVs(lex, func(path []string, value string) error {
+		section := root
+		for _, name := range path[:len(path)-1] {
+			child, ok := section[name]
+			if !ok {
+				child = map[string]interface{}{}
+				section[name] = child
+			}
+
+			section, ok = child.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("section %q conflicts with a key of the same name", strings.Join(path[:len(path)-1], "."))
+			}
+		}
+
+		key := path[len(path)-1]
+		if _, ok := section[key].(map[string]interface{}); ok {
+			return fmt.Errorf("key %q conflicts with a section of the same name", strings.Join(path, "."))
+		}
+		section[key] = value
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return json.NewEncoder(w).Encode(root)
+}
+
+// setInFile rewrites filename, setting the key named by an assignment
+// of the form "section.sub.key=value". The file is replaced atomically.
+func setInFile(filename, assignment string) error {
+	eq := strings.Index(assignment, "=")
+	if eq < 1 {
+		return fmt.Errorf("-set expects path=value, got %q", assignment)
+	}
+
+	src, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	if len(src) > 1 && src[0] == 0x1f && src[1] == 0x8b {
+		return fmt.Errorf("cannot -set a compressed file")
+	}
+
+	out, err := setValue(src, assignment[:eq], assignment[eq+1:])
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(out); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(info.Mode().Perm()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), filename)
+}
+
+// setValue sets the value of dottedPath in src, leaving all other
+// bytes untouched. The value is quoted if it would otherwise not be
+// read back as-is. If the key is not defined, it is appended to the
+// end of its section, which must already exist.
+func setValue(src []byte, dottedPath, value string) ([]byte, error) {
+	encoded, err := modconfigobj.EncodeValue(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return modconfigobj.Patch(src, []modconfigobj.Change{{Path: strings.Split(dottedPath, "."), Value: encoded}})
+}
+
+// getValue finds the value at a dotted path. If the key is defined
+// more than once, the last definition wins.
+func getValue(lex *modconfigobj.Lexer, dottedPath string) (value string, found bool, err error) {
+	err = walkKVs(lex, func(path []string, v string) error {
+		if strings.Join(path, ".") == dottedPath {
+			value, found = v, true
+		}
+		return nil
+	})
+
+	return
+}
+
+// walkKVs calls fn for every key/value pair with the key's full path
+// (enclosing section names followed by the key) and the value, with
+// any quotes removed from both
+func walkKVs(lex *modconfigobj.Lexer, fn func(path []string, value string) error) error {
 	for {
 		t := lex.NextItem()
 		switch t.TokenType {
 		case modconfigobj.ItemError:
-			fmt.Printf("bad token at %d", t.Position)
-			os.Exit(2)
-		case modconfigobj.ItemSection:
-			depth := -1
-			for i := 0; i < len(t.Value); i++ {
-				if t.Value[i] == '[' {
-					depth++
-				} else {
-					break
-				}
+			if t.Filename != "" {
+				return errors.New(t.String())
 			}
-			cleanSectionName := strings.TrimSpace(strings.TrimLeft(strings.TrimRight(t.Value, "]"), "["))
-			sectionStack = append(sectionStack[:depth], cleanSectionName)
+			return fmt.Errorf("bad token at %d: %s", t.Position, t.Message)
 		case modconfigobj.ItemKey:
 			valueToken := lex.NextItem()
 			if valueToken.TokenType != modconfigobj.ItemValue {
-				fmt.Printf("unexpected token at %d: %v", valueToken.Position, valueToken)
-				os.Exit(2)
+				return fmt.Errorf("unexpected token at %d: %v", valueToken.Position, valueToken)
+			}
+
+			path := append(lex.CurrentSection(), modconfigobj.DecodeValue(t.Value))
+			if err := fn(path, modconfigobj.DecodeValue(valueToken.Value)); err != nil {
+				return err
 			}
-			fmt.Printf("%s.%s=%s\n", strings.Join(sectionStack, "."), strings.TrimSpace(t.Value), strings.TrimSpace(valueToken.Value))
 		case modconfigobj.ItemEOF:
-			return
+			return nil
 		}
 	}
 }
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const fixture = `
+[section]
+key = value
+[[sub]]
+other = thing
+`
+
+const fixtureKVs = "section.key=value\nsection.sub.other=thing\n"
+
+func writeFixture(t *testing.T, name string, content []byte) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func Test_PlainFile(t *testing.T) {
+	path := writeFixture(t, "config.ini", []byte(fixture))
+
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{path}, &stdout, &stderr); code != 0 {
+		t.Fatalf("expected exit code 0, got %d: %s", code, stderr.String())
+	}
+	if stdout.String() != fixtureKVs {
+		t.Errorf("expected %q, got %q", fixtureKVs, stdout.String())
+	}
+}
+
+func Test_RootKeys(t *testing.T) {
+	path := writeFixture(t, "config.ini", []byte("name = app\nworkers = 4\n[section]\nkey = value\n"))
+
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{path}, &stdout, &stderr); code != 0 {
+		t.Fatalf("expected exit code 0, got %d: %s", code, stderr.String())
+	}
+	if expected := "name=app\nworkers=4\nsection.key=value\n"; stdout.String() != expected {
+		t.Errorf("expected %q, got %q", expected, stdout.String())
+	}
+}
+
+func Test_GzipFile(t *testing.T) {
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write([]byte(fixture))
+	gz.Close()
+
+	path := writeFixture(t, "config.ini.gz", compressed.Bytes())
+
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{path}, &stdout, &stderr); code != 0 {
+		t.Fatalf("expected exit code 0, got %d: %s", code, stderr.String())
+	}
+	if stdout.String() != fixtureKVs {
+		t.Errorf("expected %q, got %q", fixtureKVs, stdout.String())
+	}
+}
+
+func Test_JSONFormat(t *testing.T) {
+	path := writeFixture(t, "config.ini", []byte(fixture))
+
+	cases := []struct {
+		args     []string
+		expected interface{}
+	}{
+		{
+			args: []string{"-format", "json", path},
+			expected: map[string]interface{}{
+				"section.key":       "value",
+				"section.sub.other": "thing",
+			},
+		},
+		{
+			args: []string{"-format", "json", "-nested", path},
+			expected: map[string]interface{}{
+				"section": map[string]interface{}{
+					"key": "value",
+					"sub": map[string]interface{}{
+						"other": "thing",
+					},
+				},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		var stdout, stderr bytes.Buffer
+		if code := run(c.args, &stdout, &stderr); code != 0 {
+			t.Fatalf("%v: expected exit code 0, got %d: %s", c.args, code, stderr.String())
+		}
+
+		var got interface{}
+		if err := json.Unmarshal(stdout.Bytes(), &got); err != nil {
+			t.Fatalf("%v: invalid JSON %q: %v", c.args, stdout.String(), err)
+		}
+		if !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("%v: expected %v, got %v", c.args, c.expected, got)
+		}
+	}
+}
+
+func Test_UnknownFormat(t *testing.T) {
+	path := writeFixture(t, "config.ini", []byte(fixture))
+
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"-format", "yaml", path}, &stdout, &stderr); code != 1 {
+		t.Errorf("expected exit code 1, got %d", code)
+	}
+}
+
+func Test_Get(t *testing.T) {
+	path := writeFixture(t, "config.ini", []byte(fixture))
+
+	cases := []struct {
+		key    string
+		code   int
+		output string
+	}{
+		{"section.key", 0, "value\n"},
+		{"section.sub.other", 0, "thing\n"},
+		{"section.missing", 3, ""},
+		{"sub.other", 3, ""},
+	}
+
+	for _, c := range cases {
+		var stdout, stderr bytes.Buffer
+		if code := run([]string{"-get", c.key, path}, &stdout, &stderr); code != c.code {
+			t.Errorf("%s: expected exit code %d, got %d: %s", c.key, c.code, code, stderr.String())
+		}
+		if stdout.String() != c.output {
+			t.Errorf("%s: expected %q, got %q", c.key, c.output, stdout.String())
+		}
+	}
+}
+
+func Test_GetQuoted(t *testing.T) {
+	path := writeFixture(t, "config.ini", []byte("[db]\n\"user name\" = bob\npassword = \"s3 cret\"\n"))
+
+	cases := []struct {
+		key    string
+		output string
+	}{
+		{"db.user name", "bob\n"},
+		{"db.password", "s3 cret\n"},
+	}
+
+	for _, c := range cases {
+		var stdout, stderr bytes.Buffer
+		if code := run([]string{"-get", c.key, path}, &stdout, &stderr); code != 0 {
+			t.Errorf("%s: expected exit code 0, got %d: %s", c.key, code, stderr.String())
+		}
+		if stdout.String() != c.output {
+			t.Errorf("%s: expected %q, got %q", c.key, c.output, stdout.String())
+		}
+	}
+}
+
+func Test_Set(t *testing.T) {
+	const src = `# settings
+[section]
+  key = value  
+  other = 'quoted'
+[[sub]]
+  key = nested
+[second]
+key = value
+`
+
+	cases := []struct {
+		name       string
+		assignment string
+		expected   string
+	}{
+		{
+			name:       "existing key",
+			assignment: "section.key=changed",
+			expected:   strings.Replace(src, "  key = value  \n", "  key = changed  \n", 1),
+		},
+		{
+			name:       "nested key",
+			assignment: "section.sub.key=changed",
+			expected:   strings.Replace(src, "key = nested", "key = changed", 1),
+		},
+		{
+			name:       "new key",
+			assignment: "section.added=new value",
+			expected:   strings.Replace(src, "  other = 'quoted'\n", "  other = 'quoted'\n  added = new value\n", 1),
+		},
+		{
+			name:       "new key in the last section",
+			assignment: "second.added=x",
+			expected:   src[:len(src)-1] + "\nadded = x\n",
+		},
+		{
+			name:       "value spanning lines",
+			assignment: "second.key=a\nb",
+			expected:   src[:len(src)-len("value\n")] + "\"\"\"a\nb\"\"\"\n",
+		},
+		{
+			name:       "value with quotes and a leading '#'",
+			assignment: "second.key=#\"x\"",
+			expected:   src[:len(src)-len("value\n")] + "'#\"x\"'\n",
+		},
+		{
+			name:       "new root key",
+			assignment: "root=x",
+			expected:   "root = x\n" + src,
+		},
+	}
+
+	for _, c := range cases {
+		path := writeFixture(t, "config.ini", []byte(src))
+
+		var stdout, stderr bytes.Buffer
+		if code := run([]string{"-set", c.assignment, path}, &stdout, &stderr); code != 0 {
+			t.Fatalf("%s: expected exit code 0, got %d: %s", c.name, code, stderr.String())
+		}
+
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != c.expected {
+			t.Errorf("%s: expected\n%s\ngot\n%s", c.name, c.expected, got)
+		}
+	}
+}
+
+func Test_SetUnquotable(t *testing.T) {
+	path := writeFixture(t, "config.ini", []byte(fixture))
+
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"-set", `section.key='''"""`, path}, &stdout, &stderr); code == 0 {
+		t.Error("expected a non-zero exit code for a value that can't be quoted")
+	}
+}
+
+func Test_SetMissingSection(t *testing.T) {
+	path := writeFixture(t, "config.ini", []byte(fixture))
+
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"-set", "nope.key=x", path}, &stdout, &stderr); code == 0 {
+		t.Error("expected a non-zero exit code for a missing section")
+	}
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != fixture {
+		t.Errorf("file was modified: %q", got)
+	}
+}
+
+func Test_ErrorNamesFile(t *testing.T) {
+	path := writeFixture(t, "broken.ini", []byte("[section]\nkey\n"))
+
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{path}, &stdout, &stderr); code != 2 {
+		t.Errorf("expected exit code 2, got %d", code)
+	}
+	if expected := path + ":2:1: "; !strings.HasPrefix(stderr.String(), expected) {
+		t.Errorf("expected an error beginning %q, got %q", expected, stderr.String())
+	}
+}
+
+func Test_SkippedSectionLevel(t *testing.T) {
+	path := writeFixture(t, "skipped.ini", []byte("[[b]]\nkey = value\n"))
+
+	// the missing level is named "", as by Lexer.CurrentSection
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{path}, &stdout, &stderr); code != 0 {
+		t.Errorf("expected exit code 0, got %d: %s", code, stderr.String())
+	}
+	if expected := ".b.key=value\n"; stdout.String() != expected {
+		t.Errorf("expected %q, got %q", expected, stdout.String())
+	}
+}
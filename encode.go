@@ -0,0 +1,49 @@
+package modconfigobj
+
+import (
+	"fmt"
+	"strings"
+)
+
+// EncodeValue returns s as it should be written following a key's
+// separator, quoting it if necessary, so that the lexer reads back a
+// value which is s once its quotes are removed.
+//
+// Values are quoted only when they would otherwise not be read back
+// as-is, such as a value with surrounding whitespace, an opening quote
+// or '#', or a newline. The quotes used are whichever kind s doesn't
+// contain, falling back on triple quotes, which are always used for a
+// value spanning lines. The lexer has no escapes within quoted values,
+// so it is an error if s contains every kind of quote that could
+// enclose it, as when it holds both kinds of triple quote.
+func EncodeValue(s string) (string, error) {
+	return quoteValue(s, false)
+}
+
+// quoteValue is EncodeValue, quoting s even if it could be written
+// as-is when force is set
+func quoteValue(s string, force bool) (string, error) {
+	if !force && s != "" && s == strings.TrimSpace(s) && !strings.ContainsAny(s[:1], `"'#`) && !strings.Contains(s, "\n") {
+		return s, nil
+	}
+
+	quotes := []string{`"`, `'`, `"""`, `'''`}
+	if strings.Contains(s, "\n") {
+		quotes = quotes[2:]
+	}
+	for _, q := range quotes {
+		// a quote ending s would run into the closing quotes
+		if !strings.Contains(s, q) && !strings.HasSuffix(s, q[:1]) {
+			return q + s + q, nil
+		}
+	}
+
+	return "", fmt.Errorf("value %q cannot be quoted", s)
+}
+
+// DecodeValue returns the value written as s, without the whitespace
+// and quotes surrounding it, so that DecodeValue reverses EncodeValue.
+// It serves for quoted keys too.
+func DecodeValue(s string) string {
+	return unquote(strings.TrimSpace(s))
+}
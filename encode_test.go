@@ -0,0 +1,51 @@
+package modconfigobj_test
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/christian-blades-cb/modconfigobj"
+)
+
+func Test_EncodeValue(t *testing.T) {
+	alphabet := []rune(`ab =,#"'` + "\n\t[]\\")
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		s := make([]rune, rng.Intn(8))
+		for j := range s {
+			s[j] = alphabet[rng.Intn(len(alphabet))]
+		}
+
+		encoded, err := modconfigobj.EncodeValue(string(s))
+		if err != nil {
+			// only a value holding a triple quote can run out of quotes
+			if !strings.Contains(string(s), `'''`) && !strings.Contains(string(s), `"""`) {
+				t.Errorf("%q: unexpected error %v", string(s), err)
+			}
+			continue
+		}
+
+		src := "v = " + encoded + "\n"
+		lex := modconfigobj.NewLexer(strings.NewReader(src))
+		if key := lex.NextItem(); key.TokenType != modconfigobj.ItemKey {
+			t.Fatalf("%q: expected a key, got %v", src, key)
+		}
+		value := lex.NextItem()
+		if value.TokenType != modconfigobj.ItemValue {
+			t.Errorf("%q: expected a value, got %v", src, value)
+			continue
+		}
+		if got := modconfigobj.DecodeValue(value.Value); got != string(s) {
+			t.Errorf("%q: got %q back from %q", string(s), got, src)
+		}
+	}
+}
+
+func Test_EncodeValueErrors(t *testing.T) {
+	for _, s := range []string{`'''"""`, `'''x"`} {
+		if encoded, err := modconfigobj.EncodeValue(s); err == nil {
+			t.Errorf("%q: expected an error, got %q", s, encoded)
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package modconfigobj
+
+// DoubleBackup makes the lexer's next state read a rune and then back
+// up twice, as a buggy state function might
+func DoubleBackup(l *Lexer) {
+	l.state = func(l *Lexer) stateFn {
+		l.next()
+		l.backup()
+		l.backup()
+		return nil
+	}
+}
+
+// ResetBeforeBackup makes the lexer's next state read a rune and reset
+// the token buffer before backing up over the rune
+func ResetBeforeBackup(l *Lexer) {
+	l.state = func(l *Lexer) stateFn {
+		l.next()
+		l.resetTokenBuffer()
+		l.backup()
+		return lexGeneric
+	}
+}
@@ -0,0 +1,53 @@
+package modconfigobj
+
+import (
+	"io"
+	"regexp"
+	"strings"
+)
+
+// Match is a key found by Grep
+type Match struct {
+	// Section is the path of the sections enclosing the key, outermost
+	// first, and is empty for a key ahead of any section header
+	Section []string
+	Key     string
+	Value   string
+
+	// Position is the byte offset of the key in the input
+	Position int64
+}
+
+// Grep lexes r and returns every key whose name matches keyPattern,
+// in the order they appear. The name matched (and returned as Key) is
+// unquoted and trimmed of whitespace, and so is the Value. Lexing stops
+// at the first invalid token, which is returned as a LexError along
+// with the matches found up to that point.
+func Grep(r io.Reader, keyPattern *regexp.Regexp) ([]Match, error) {
+	var matches []Match
+
+	lex := NewLexerFromReader(r)
+	lex.TrimValues = true
+
+	var match *Match
+	for {
+		t := lex.NextItem()
+		switch t.TokenType {
+		case ItemError:
+			return matches, newLexError(t)
+		case ItemKey:
+			match = nil
+			if key := unquote(strings.TrimSpace(t.Value)); keyPattern.MatchString(key) {
+				match = &Match{Section: lex.CurrentSection(), Key: key, Position: t.Position}
+			}
+		case ItemValue:
+			if match != nil {
+				match.Value = unquote(t.Value)
+				matches = append(matches, *match)
+				match = nil
+			}
+		case ItemEOF:
+			return matches, nil
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package modconfigobj_test
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/christian-blades-cb/modconfigobj"
+)
+
+func Test_Grep(t *testing.T) {
+	const src = `admin_password = hunter2
+user = admin
+
+[db]
+password = "s3cret"
+host = localhost
+
+  [[replica]]
+  'replica password' = other
+
+[api]
+token = abc
+`
+
+	matches, err := modconfigobj.Grep(strings.NewReader(src), regexp.MustCompile(`(?i)password`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []modconfigobj.Match{
+		{Key: "admin_password", Value: "hunter2", Position: 0},
+		{Section: []string{"db"}, Key: "password", Value: "s3cret", Position: int64(strings.Index(src, "\npassword") + 1)},
+		{Section: []string{"db", "replica"}, Key: "replica password", Value: "other", Position: int64(strings.Index(src, "'replica"))},
+	}
+	if !reflect.DeepEqual(matches, expected) {
+		t.Errorf("expected %+v, got %+v", expected, matches)
+	}
+}
+
+func Test_GrepError(t *testing.T) {
+	const src = "password = a\n[broken\npassword = b\n"
+
+	matches, err := modconfigobj.Grep(strings.NewReader(src), regexp.MustCompile("password"))
+	if _, ok := err.(modconfigobj.LexError); !ok {
+		t.Errorf("expected a LexError, got %v", err)
+	}
+	if len(matches) != 1 || matches[0].Value != "a" {
+		t.Errorf("expected the match ahead of the error, got %+v", matches)
+	}
+}
@@ -1,10 +1,14 @@
 package modconfigobj
 
 import (
+	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"strings"
 	"unicode"
+	"unicode/utf8"
 )
 
 type itemType int
@@ -18,6 +22,13 @@ const (
 	ItemComment
 
 	// ItemKey is a key from a key/value pair
+	//
+	// Note: token value includes quotes (if those exist)
+	//
+	// Note: the key ends at the first '=' (or Lexer.Separator) on the
+	// line, so any later '=' belongs to the value ("url = a=b" has the value "a=b", and
+	// "key== x" has the value "= x"). A line starting with '=' has no
+	// key and is an error.
 	ItemKey
 
 	// ItemValue is the value of a key/value pair
@@ -34,6 +45,18 @@ const (
 
 	// ItemEOF is the final token returned when the lexer reaches the end of a file
 	ItemEOF
+
+	// ItemWhitespace is a run of whitespace between tokens, only
+	// emitted when Lexer.EmitWhitespace is set
+	//
+	// Note: the whitespace following a key includes the '=' (and the
+	// '+' of an append) separating it from its value
+	ItemWhitespace
+
+	// ItemCustom is the first token type free for the tokens emitted by
+	// Lexer.RegisterPrefix handlers, which may use ItemCustom,
+	// ItemCustom+1 and so on
+	ItemCustom itemType = 100
 )
 
 func (i itemType) String() string {
@@ -50,6 +73,15 @@ func (i itemType) String() string {
 		return "Section"
 	case ItemEOF:
 		return "EOF"
+	case ItemWhitespace:
+		return "Whitespace"
+	}
+
+	switch {
+	case i == ItemCustom:
+		return "Custom"
+	case i > ItemCustom:
+		return fmt.Sprintf("Custom+%d", i-ItemCustom)
 	default:
 		return "DOESNOTEXIST"
 	}
@@ -59,15 +91,122 @@ func (i itemType) String() string {
 // Token is the representation of lexeme and category. Len and
 // Position are also available for applications such as mutating a
 // file in-place. Units for Len and Position are bytes.
+//
+// Depth and Name are only populated for ItemSection tokens. Depth is
+// the number of brackets enclosing the section (1 for a top-level
+// section), and Name is the section name without brackets or
+// surrounding whitespace. Message describes the problem for ItemError
+// tokens.
+//
+// Separator is populated for ItemValue tokens with the exact text
+// between the end of the key name and the start of the value, e.g.
+// " = " for "key = value" or "=" for "key=value". Append is set on
+// ItemValue tokens that follow a "+=" separator.
+//
+// Comment holds the comment trailing a section header on the same line
+// (including the '#') when the lexer's InlineSectionComments is set.
+//
+// Inline is set on ItemComment tokens that trail another token on the
+// same line, rather than standing on a line of their own.
+//
+// Context holds the line on which an ItemError begins, as far as the
+// lexer had read it (and at most maxContextBytes of it), and Column is
+// the byte offset of the error within that line. String renders them
+// as a snippet with a caret under the error. Context is left empty for
+// an error beginning past the part of the line that was kept.
+//
+// Filename and Line are also only populated for ItemError tokens, with
+// the lexer's Filename, if any, and the 1-based number of the line on
+// which the error begins. When Filename is set, String describes the error in
+// the form "filename:line:col: message", where col is Column + 1.
 type Token struct {
 	TokenType itemType
 	Position  int64
 	Len       int64
 	Value     string
+	Depth     int
+	Name      string
+	Message   string
+	Separator string
+	Append    bool
+	Comment   string
+	Inline    bool
+	Context   string
+	Column    int
+	Filename  string
+	Line      int
+
+	// err is the read error behind an ItemError, see NextItemErr
+	err error
+
+	// borrowed tokens have their text in the lexer's arena rather than
+	// in Value, and a value's separator just before it, see NextView
+	borrowed                     bool
+	sepStart, textStart, textEnd int
 }
 
 func (t Token) String() string {
-	return fmt.Sprintf("token %s at %d: \"%s\"", t.TokenType, t.Position, t.Value)
+	if t.TokenType == ItemError && t.Filename != "" {
+		return fmt.Sprintf("%s:%d:%d: %s", t.Filename, t.Line, t.Column+1, t.Message) + snippet(t.Context, t.Column)
+	}
+	return fmt.Sprintf("token %s at %d: \"%s\"", t.TokenType, t.Position, t.Value) + snippet(t.Context, t.Column)
+}
+
+// maxContextBytes bounds the line kept by the lexer for error Context
+const maxContextBytes = 256
+
+// snippet renders line with a caret beneath the byte offset column,
+// or nothing if there is no line
+func snippet(line string, column int) string {
+	if line == "" {
+		return ""
+	}
+
+	// copy tabs so that the caret lines up however they're displayed
+	var pad strings.Builder
+	for _, r := range line[:column] {
+		if r == '\t' {
+			pad.WriteRune('\t')
+		} else {
+			pad.WriteRune(' ')
+		}
+	}
+
+	return fmt.Sprintf("\n\t%s\n\t%s^", line, pad.String())
+}
+
+// IsError reports whether t is an ItemError token
+func (t Token) IsError() bool { return t.TokenType == ItemError }
+
+// IsComment reports whether t is an ItemComment token
+func (t Token) IsComment() bool { return t.TokenType == ItemComment }
+
+// IsKey reports whether t is an ItemKey token
+func (t Token) IsKey() bool { return t.TokenType == ItemKey }
+
+// IsValue reports whether t is an ItemValue token
+func (t Token) IsValue() bool { return t.TokenType == ItemValue }
+
+// IsSection reports whether t is an ItemSection token
+func (t Token) IsSection() bool { return t.TokenType == ItemSection }
+
+// IsEOF reports whether t is the final ItemEOF token
+func (t Token) IsEOF() bool { return t.TokenType == ItemEOF }
+
+// End returns the offset of the first byte following t's span
+func (t Token) End() int64 { return t.Position + t.Len }
+
+// TokenAt finds the token whose span contains the byte offset. The
+// second return value is false if the offset falls between tokens
+// (e.g. on whitespace or a separator) or outside of the input.
+func TokenAt(tokens []Token, offset int64) (Token, bool) {
+	for _, t := range tokens {
+		if offset >= t.Position && offset < t.End() {
+			return t, true
+		}
+	}
+
+	return Token{}, false
 }
 
 // Reader is an object that can emit single runes
@@ -87,44 +226,552 @@ type Buffer interface {
 
 // Lexer tokenizes the configobj file
 type Lexer struct {
+	// IndentContinuation allows an unquoted value to span several
+	// lines. A line indented further than the value's key is appended
+	// to the value, newline and indentation included.
+	IndentContinuation bool
+
+	// SectionOpen and SectionClose are the runes delimiting section
+	// headers, "[" and "]" by default. Nesting is expressed by repeating
+	// them, e.g. "<<sub>>" with angle brackets.
+	SectionOpen  rune
+	SectionClose rune
+
+	// Separator is the string between a key and its value, "=" by
+	// default or if left empty. Text that only begins like the
+	// separator, such as the "=" of "a=b => c" when it is "=>", is part
+	// of the key, but the separator may overlap it, so "a :::= b" is
+	// the key "a :" when it is "::=".
+	Separator string
+
+	// SectionEscapes treats "\[" and "\]" (or the configured section
+	// delimiters) within a section header as literal characters rather
+	// than depth markers. The escapes are kept
+	// in the section's Value and Name unless DecodeSectionEscapes is
+	// also set, in which case the backslashes are dropped.
+	SectionEscapes       bool
+	DecodeSectionEscapes bool
+
+	// RecoverSections treats a section header left open at the end of a
+	// line as if its close delimiters were present. The unterminated
+	// header is still reported by an ItemError, which is followed by an
+	// ItemSection covering the same span, named for the rest of the line.
+	RecoverSections bool
+
+	// IndentBasedNesting (experimental) derives the Depth of a section
+	// from the indentation of its header instead of from its brackets,
+	// so an indented "[b]" following "[a]" is a subsection of a. The
+	// first indented header fixes the unit of indentation. A header
+	// that isn't indented by a whole number of units, or that is more
+	// than one unit deeper than the section before it, is an error.
+	IndentBasedNesting bool
+
+	// AllowAppend recognizes "key += value" as appending to the key
+	// rather than as a key named "key +". The resulting ItemValue token
+	// has Append set.
+	AllowAppend bool
+
+	// KeyValidator, if set, is called with each key name (without the
+	// whitespace preceding the separator) before it is emitted. If it
+	// returns an error, the rest of the line is emitted as an ItemError
+	// carrying the error's message.
+	KeyValidator func(string) error
+
+	// OnSection, if set, is called with the depth and name of each
+	// section header before it is emitted. If it returns an error, an
+	// ItemError carrying the error's message is emitted in place of the
+	// section, and the keys that follow stay in the enclosing section.
+	OnSection func(depth int, name string) error
+
+	// Heredocs enables values of the form
+	//
+	//	key = <<END
+	//	...
+	//	END
+	//
+	// where every line up to the closing marker is part of the value.
+	// The emitted Value is the raw text, from "<<" through the closing
+	// marker.
+	Heredocs bool
+
+	// MaxTokenBytes, if positive, caps the size of a single token. When
+	// a token grows past the limit the lexer emits an ItemError and
+	// stops, protecting against unbounded memory use on untrusted
+	// input.
+	MaxTokenBytes int
+
+	// InlineSectionComments attaches a comment following a section
+	// header on the same line to the section token's Comment, instead
+	// of emitting it as a separate ItemComment. The section's Len does
+	// not include the comment.
+	InlineSectionComments bool
+
+	// AllowFlagKeys accepts a key on a line of its own, with no '=' or
+	// value, emitting it as an ItemKey followed by an empty ItemValue.
+	// In this mode a '#' following whitespace in such a key begins a
+	// comment, so "debug # comment" is the flag "debug" and a comment.
+	AllowFlagKeys bool
+
+	// ASCIIWhitespaceOnly restricts the whitespace skipped between
+	// tokens to space, tab, CR and LF. Other Unicode spaces, such as
+	// U+00A0 NO-BREAK SPACE, are then kept as part of keys and values.
+	ASCIIWhitespaceOnly bool
+
+	// TrimValues strips leading and trailing whitespace from the Value
+	// of each ItemValue. Position and Len still cover the raw span, so a
+	// trimmed Value may be shorter than Len.
+	TrimValues bool
+
+	// EmitWhitespace emits an ItemWhitespace token for every run of
+	// whitespace between other tokens, so that concatenating the Value
+	// of every token reproduces the input. The one exception is a
+	// comment following a section header under InlineSectionComments,
+	// which is only carried by the section's Comment.
+	EmitWhitespace bool
+
+	// CommentsAtLineStartOnly only treats '#' as the start of a comment
+	// in the first column. An indented or trailing '#' is lexed as
+	// ordinary text, so "   # x" is read as a (malformed) key. This
+	// overrides the trailing comments of AllowFlagKeys and
+	// InlineSectionComments.
+	CommentsAtLineStartOnly bool
+
+	// InlineValueComments ends an unquoted value at a '#' that begins
+	// the value or follows whitespace, emitting the rest of the line as
+	// an inline ItemComment. The whitespace before the '#' is not part
+	// of the value.
+	InlineValueComments bool
+
+	// CommentEscapes reads "\#" in an unquoted value as a literal '#'
+	// that never begins an inline comment. The backslash is dropped
+	// from the Value, so Len still covers the raw span but Value is
+	// shorter.
+	CommentEscapes bool
+
+	// SlashComments also begins a comment with "//", as in C-style
+	// configs, on a line of its own or following a section header. The
+	// emitted ItemComment includes the "//". A single '/' is ordinary
+	// text, as is "//" within a key or value, so "path = a//b" is
+	// unaffected. CommentsAtLineStartOnly applies as it does to '#'.
+	SlashComments bool
+
+	// MultilineQuotes allows a value in single quotes, "..." or
+	// '...', to run over several lines. Otherwise a newline before the
+	// closing quote is an error, and a value spanning lines must use
+	// triple quotes, which may always contain newlines.
+	MultilineQuotes bool
+
+	// Filename names the input in ItemError tokens, and so in the
+	// errors built from them, for tools that lex many files.
+	Filename string
+
 	input          Reader
 	tokenValBuffer Buffer
 	prevRuneSize   int
 	Position       int64
 	start          int64
+	lineStart      int64
+	prevLineStart  int64
+	line           int
+	keyColumn      int64
+	separator      []byte
+	appendValue    bool
 	tokenStream    chan Token
 	state          stateFn
+	peeked         Token
+	hasPeeked      bool
+	sectionStack   []string
+	keySection     []string
+	lastEnd        int64
+	lineText       []byte
+	prefixes       map[rune]func(*Lexer) Token
+	borrow         bool
+	arena          []byte
+	indentUnit     string
+	indentDepth    int
+	prevLineText   []byte
+	readErr        error
+	skipped        []LexError
+	stats          Stats
+}
+
+// Stats counts the tokens a Lexer has produced
+type Stats struct {
+	Sections int
+	Keys     int
+	Comments int
+	Errors   int
+}
+
+const (
+	defaultTokenBuffer = 3
+
+	// a single state function may emit up to two tokens (e.g. an
+	// error followed by EOF) before the caller can drain the stream
+	minTokenBuffer = 2
+)
+
+// Option configures a Lexer created with NewLexerWithOptions
+type Option func(*Lexer)
+
+// WithTokenBuffer sets the number of tokens the lexer may queue ahead
+// of the caller. Sizes below the number of tokens a single state can
+// emit are raised to that minimum.
+func WithTokenBuffer(n int) Option {
+	return func(l *Lexer) {
+		if n < minTokenBuffer {
+			n = minTokenBuffer
+		}
+		l.tokenStream = make(chan Token, n)
+	}
+}
+
+// WithFilename sets the lexer's Filename
+func WithFilename(name string) Option {
+	return func(l *Lexer) {
+		l.Filename = name
+	}
 }
 
 // NewLexer initializes a Lexer for the given input
 func NewLexer(input Reader) *Lexer {
-	return &Lexer{
+	return NewLexerWithOptions(input)
+}
+
+// NewLexerFromReader initializes a Lexer for any io.Reader, buffering
+// it so that runes can be read and unread
+func NewLexerFromReader(r io.Reader) *Lexer {
+	return NewLexer(bufio.NewReader(r))
+}
+
+// NewLexerWithOptions initializes a Lexer for the given input,
+// applying opts in order
+func NewLexerWithOptions(input Reader, opts ...Option) *Lexer {
+	l := &Lexer{
+		SectionOpen:    '[',
+		SectionClose:   ']',
+		Separator:      "=",
 		state:          lexGeneric,
 		input:          input,
 		tokenValBuffer: bytes.NewBuffer(nil),
-		tokenStream:    make(chan Token, 3),
+		tokenStream:    make(chan Token, defaultTokenBuffer),
+	}
+
+	for _, opt := range opts {
+		opt(l)
 	}
+
+	return l
 }
 
 // NextItem provides the next token from the lexer's stream. It is the
 // caller's resposibility to check for a ItemEOF token which signals
-// the end of the token stream.
+// the end of the token stream. Once the stream has ended, every further
+// call returns another ItemEOF.
 func (l *Lexer) NextItem() Token {
+	t := l.nextToken()
+	if t.borrowed {
+		// lexed for NextView, so the text needs copying out
+		t.Value = string(l.arena[t.textStart:t.textEnd])
+		if t.TokenType == ItemValue {
+			t.Separator = string(l.arena[t.sepStart:t.textStart])
+		}
+		t.borrowed, t.sepStart, t.textStart, t.textEnd = false, 0, 0, 0
+	}
+
+	return t
+}
+
+// TokenView is a Token returned by NextView. For keys, values, comments
+// and sections, Value is left empty and the token's text is borrowed
+// from the lexer instead, to be read with Text. Likewise a value's
+// Separator is left empty, to be read with SeparatorText.
+type TokenView struct {
+	Token
+
+	text, separator []byte
+}
+
+// Text returns the token's text. Borrowed text is only valid until the
+// next call to NextView, NextItem or Peek, and must not be modified;
+// copy it to keep it any longer. Text allocates a copy of Value for
+// any other token.
+func (v TokenView) Text() []byte {
+	if v.borrowed {
+		return v.text
+	}
+	return []byte(v.Value)
+}
+
+// SeparatorText returns a value's separator, borrowed like Text.
+func (v TokenView) SeparatorText() []byte {
+	if v.borrowed {
+		return v.separator
+	}
+	return []byte(v.Separator)
+}
+
+// NextView is NextItem with fewer allocations, for hot loops that can
+// do without a string for every token. The text of keys, values and
+// comments is borrowed from the lexer's own buffer rather than copied,
+// see TokenView. NextView is not allocation-free: a section still
+// carries its Name, which the section stack must keep, though a name
+// already on the stack is reused rather than copied again.
+func (l *Lexer) NextView() TokenView {
+	if len(l.tokenStream) == 0 && !l.hasPeeked {
+		// nothing queued borrows from the arena, and the caller's
+		// previous view is no longer valid
+		l.arena = l.arena[:0]
+	}
+
+	l.borrow = true
+	t := l.nextToken()
+	l.borrow = false
+
+	v := TokenView{Token: t}
+	if t.borrowed {
+		v.text = l.arena[t.textStart:t.textEnd:t.textEnd]
+		if t.TokenType == ItemValue {
+			v.separator = l.arena[t.sepStart:t.textStart:t.textStart]
+		}
+	}
+	return v
+}
+
+// nextToken returns the next token as it was emitted
+func (l *Lexer) nextToken() Token {
+	if l.hasPeeked {
+		l.hasPeeked = false
+		return l.peeked
+	}
+
 	for {
 		select {
 		case t := <-l.tokenStream:
 			return t
 		default:
-			l.state = l.state(l)
+			if l.state == nil {
+				return Token{TokenType: ItemEOF, Position: l.Position}
+			}
+			l.step()
+		}
+	}
+}
+
+// NextItemErr is NextItem, additionally returning the underlying error
+// when the input could not be read. The accompanying token is the
+// ItemError describing the failure, and is followed by ItemEOF.
+func (l *Lexer) NextItemErr() (Token, error) {
+	t := l.NextItem()
+	return t, t.err
+}
+
+// NextValid is NextItem for lenient consumers, skipping over ItemError
+// tokens so that the good parts of a broken input can still be used.
+// The skipped errors are collected for Err.
+func (l *Lexer) NextValid() Token {
+	for {
+		t := l.NextItem()
+		if t.TokenType != ItemError {
+			return t
+		}
+		l.skipped = append(l.skipped, newLexError(t))
+	}
+}
+
+// Err returns the errors skipped by NextValid so far as LexErrors, or
+// nil if there were none
+func (l *Lexer) Err() error {
+	if len(l.skipped) == 0 {
+		return nil
+	}
+	return append(LexErrors(nil), l.skipped...)
+}
+
+// errTokenTooLarge aborts the running state when a token outgrows
+// MaxTokenBytes
+var errTokenTooLarge = errors.New("token too large")
+
+// errDoubleBackup aborts the running state when backup is called
+// without a rune to step back over, i.e. twice in a row
+var errDoubleBackup = errors.New("backup called before a call to next")
+
+// readError aborts the running state when the input fails
+type readError struct {
+	err error
+}
+
+// step runs the current state, turning aborted states into a final
+// error token rather than letting the panic escape to the caller
+func (l *Lexer) step() {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+
+		if re, ok := r.(readError); ok {
+			l.readErr = re.err
+			l.state = lexReadError
+			return
+		}
+		if r == errTokenTooLarge {
+			l.state = lexTokenTooLarge
+			return
 		}
+		if r == errDoubleBackup {
+			l.state = lexDoubleBackup
+			return
+		}
+
+		panic(r)
+	}()
+
+	if l.Separator == "" {
+		l.Separator = "="
+	}
+	l.state = l.state(l)
+}
+
+func lexReadError(l *Lexer) stateFn {
+	t := l.errorToken(l.readErr.Error())
+	t.err = l.readErr
+	l.send(t)
+	l.resetTokenBuffer()
+
+	l.emit(ItemEOF)
+	return nil
+}
+
+func lexTokenTooLarge(l *Lexer) stateFn {
+	l.errorf("token too large, exceeds %d bytes", l.MaxTokenBytes)
+	l.emit(ItemEOF)
+	return nil
+}
+
+func lexDoubleBackup(l *Lexer) stateFn {
+	l.errorf("internal error: %s", errDoubleBackup)
+	l.emit(ItemEOF)
+	return nil
+}
+
+// Peek returns the next token without consuming it. The following
+// call to NextItem (or Peek) returns the same token.
+func (l *Lexer) Peek() Token {
+	if !l.hasPeeked {
+		l.peeked = l.NextItem()
+		l.hasPeeked = true
+	}
+
+	return l.peeked
+}
+
+// RelexFrom discards any tokens not yet returned and resumes lexing at
+// the byte offset in the input, which must implement io.Seeker (as
+// strings.Reader and bytes.Reader do). offset must be the start of a
+// line outside of any multi-line value, such as the start of a section
+// header, or the tokens that follow will be garbage.
+//
+// Nothing lexed before offset is remembered, so the section stack is
+// emptied: CurrentSection is empty until the next header, and headers
+// are nested as though they began the input, and the Line of error
+// tokens counts from the line at offset.
+func (l *Lexer) RelexFrom(offset int64) error {
+	seeker, ok := l.input.(io.Seeker)
+	if !ok {
+		return fmt.Errorf("RelexFrom needs an input that implements io.Seeker, got %T", l.input)
+	}
+	if _, err := seeker.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	for len(l.tokenStream) > 0 {
+		<-l.tokenStream
+	}
+	l.hasPeeked = false
+
+	l.Position = offset
+	l.prevRuneSize = 0
+	l.lineStart, l.prevLineStart = offset, offset
+	l.line = 0
+	l.lineText, l.prevLineText = l.lineText[:0], l.prevLineText[:0]
+	l.lastEnd = offset
+	l.sectionStack, l.keySection = nil, nil
+	l.indentUnit = ""
+	l.readErr = nil
+	l.resetTokenBuffer()
+	l.state = lexGeneric
+
+	return nil
+}
+
+// CurrentSection returns the path of nested section names enclosing
+// the most recently emitted key, outermost first, or following a
+// section header, the path of that section. It is empty for keys that
+// precede any section. If a section skips a level of nesting, such as
+// "[[[c]]]" directly beneath "[a]", the missing levels are reported as
+// empty names.
+func (l *Lexer) CurrentSection() []string {
+	return append([]string(nil), l.keySection...)
+}
+
+// Stats returns counts of the tokens lexed so far. The lexer may have
+// queued a token or two ahead of the last one returned by NextItem, and
+// those are included.
+func (l *Lexer) Stats() Stats {
+	return l.stats
+}
+
+// RegisterPrefix has fn lex the tokens beginning with r wherever the
+// lexer expects a key, section header or comment, taking precedence
+// over any built-in meaning of r. fn is called with r already read and
+// reads the rest of its token with ReadRune and UnreadRune. The token
+// it returns is emitted with its Position and Len covering the runes
+// read, and with the text of those runes as its Value unless fn set
+// one. Lexing then carries on as usual.
+func (l *Lexer) RegisterPrefix(r rune, fn func(*Lexer) Token) {
+	if l.prefixes == nil {
+		l.prefixes = map[rune]func(*Lexer) Token{}
+	}
+	l.prefixes[r] = fn
+}
+
+// ReadRune reads the next rune of a token for a RegisterPrefix handler.
+// It must not be called from anywhere else.
+func (l *Lexer) ReadRune() (rune, int, error) {
+	r, err := l.next()
+	return r, l.prevRuneSize, err
+}
+
+// UnreadRune steps a RegisterPrefix handler back over the rune it last
+// read. Only one rune can be unread between reads.
+func (l *Lexer) UnreadRune() error {
+	if l.prevRuneSize == 0 {
+		return errDoubleBackup
 	}
+
+	l.backup()
+	return nil
+}
+
+// Consumed returns the number of bytes read from the input so far,
+// less any runes unread by the lexer. Like Stats, it runs ahead of the
+// last token returned by NextItem. A lexer made by NewLexerFromReader
+// buffers its reader, so the underlying io.Reader may have been read
+// further still.
+func (l *Lexer) Consumed() int64 {
+	return l.Position
 }
 
 type stateFn func(*Lexer) stateFn
 
 func lexGeneric(l *Lexer) stateFn {
-	l.skipWhitespace()
-	l.resetTokenBuffer()
+	start := l.start
+	if l.emitWhitespace(start, l.skipWhitespace()) {
+		// what follows may emit an error and EOF, which would be
+		// one token too many for this step
+		return lexGeneric
+	}
 
 	var r rune
 	var err error
@@ -137,18 +784,33 @@ func lexGeneric(l *Lexer) stateFn {
 			return nil
 		}
 
+		if fn, ok := l.prefixes[r]; ok {
+			return lexPrefix(fn)
+		}
+
+		if r == '/' && l.SlashComments && !(l.CommentsAtLineStartOnly && l.start != l.lineStart) {
+			if l.slashComment() {
+				return lexCommentRest
+			}
+			return lexKeyRest
+		}
+
 		switch r {
-		case '[':
+		case l.SectionOpen:
 			l.backup()
 			return lexSection
 		case '#':
 			l.backup()
+			if l.CommentsAtLineStartOnly && l.Position != l.lineStart {
+				return lexKey
+			}
 			return lexComment
 		case '\n':
 			return lexGeneric
-		case '=':
-			l.emit(ItemError)
-			return lexGeneric
+		case l.separatorStart():
+			// the rest of the line goes into the error, rather than
+			// being lexed as a key and reported a second time
+			return l.errorLine(fmt.Sprintf("missing key before '%s'", l.Separator))
 		default:
 			l.backup()
 			return lexKey
@@ -156,42 +818,245 @@ func lexGeneric(l *Lexer) stateFn {
 	}
 }
 
+// lexPrefix returns a state emitting the token read by the
+// RegisterPrefix handler fn
+func lexPrefix(fn func(*Lexer) Token) stateFn {
+	return func(l *Lexer) stateFn {
+		t := fn(l)
+		t.Position = l.start
+		t.Len = l.Position - l.start
+		if t.Value == "" {
+			t.Value = l.tokenValBuffer.String()
+		}
+		l.send(t)
+		l.resetTokenBuffer()
+
+		return lexGeneric
+	}
+}
+
 func lexKey(l *Lexer) stateFn {
+	l.resetTokenBuffer()
+	return lexKeyRest(l)
+}
+
+// lexKeyRest reads the rest of a key, the start of which may already
+// be in the token buffer
+func lexKeyRest(l *Lexer) stateFn {
 	var r rune
 	var err error
 
-	l.resetTokenBuffer()
+	l.keyColumn = l.start - l.lineStart
+	sepStart := l.separatorStart()
 
 	for {
 		r, err = l.next()
 		if err != nil {
-			l.emit(ItemError)
+			if l.AllowFlagKeys {
+				return l.acceptFlagKey(lexGeneric)
+			}
+			l.errorf("missing '%s' after key", l.Separator)
 			l.emit(ItemEOF)
 			return nil
 		}
 
 		switch r {
+		case '"', '\'':
+			if l.Position-int64(l.prevRuneSize) == l.start {
+				return lexQuotedKey(r, l)
+			}
+		case '#':
+			if l.AllowFlagKeys && !l.CommentsAtLineStartOnly {
+				key := l.tokenValBuffer.String()
+				if prev, _ := utf8.DecodeLastRuneInString(key[:len(key)-1]); l.isSpace(prev) {
+					l.backup()
+					return l.acceptFlagKey(lexComment)
+				}
+			}
 		case '\n':
-			l.emit(ItemError)
+			if l.AllowFlagKeys {
+				l.backup()
+				return l.acceptFlagKey(lexGeneric)
+			}
+			l.errorf("missing '%s' after key", l.Separator)
 			return lexGeneric
-		case '=':
-			if l.Position-int64(l.prevRuneSize) == l.start { // empty key?
-				l.emit(ItemError)
-				return lexGeneric
+		case sepStart:
+			if l.matchSeparator() {
+				return l.acceptKey(false)
 			}
+		}
+	}
+}
+
+// lexQuotedKey reads a key wrapped in quotes, in which '=' has no
+// special meaning. The opening quote has already been consumed.
+func lexQuotedKey(quoteRune rune, l *Lexer) stateFn {
+	for {
+		r, err := l.next()
+		if err != nil {
+			l.errorf("unterminated quoted key")
+			l.emit(ItemEOF)
+			return nil
+		}
+
+		if r == '\n' {
+			l.errorf("unterminated quoted key")
+			return lexGeneric
+		}
+		if r == quoteRune {
+			break
+		}
+	}
 
+	for {
+		r, err := l.next()
+		if err != nil {
+			l.errorf("missing '%s' after key", l.Separator)
+			l.emit(ItemEOF)
+			return nil
+		}
+
+		switch {
+		case r == l.separatorStart():
+			if l.matchSeparator() {
+				return l.acceptKey(true)
+			}
+			return l.errorLine("unexpected text after quoted key")
+		case r == '+' && l.AllowAppend:
+		case l.isLineSpace(r):
+		case r == '\n':
 			l.backup()
-			l.emit(ItemKey)
-			l.next()
-			return lexValue
+			return l.errorLine(fmt.Sprintf("missing '%s' after key", l.Separator))
+		default:
+			return l.errorLine("unexpected text after quoted key")
+		}
+	}
+}
+
+// acceptFlagKey emits the key held in the token buffer, less any
+// trailing whitespace, followed by an empty value
+func (l *Lexer) acceptFlagKey(next stateFn) stateFn {
+	name := strings.TrimRightFunc(l.tokenValBuffer.String(), l.isSpace)
+	if l.KeyValidator != nil {
+		if err := l.KeyValidator(name); err != nil {
+			return l.errorLine(err.Error())
+		}
+	}
+
+	keyEnd := l.start + int64(len(name))
+	trailing := l.tokenValBuffer.String()[len(name):]
+	l.tokenValBuffer.Truncate(len(name))
+	l.emitSpan(ItemKey, keyEnd)
+	l.send(Token{TokenType: ItemValue, Position: keyEnd})
+
+	if l.EmitWhitespace && trailing != "" {
+		// a third token could overflow the smallest token buffer, so
+		// the whitespace is left for a state of its own
+		return func(l *Lexer) stateFn {
+			l.emitWhitespace(keyEnd, []byte(trailing))
+			return next
+		}
+	}
+	return next
+}
+
+// separatorStart returns the first rune of the key/value separator
+func (l *Lexer) separatorStart() rune {
+	r, _ := utf8.DecodeRuneInString(l.Separator)
+	return r
+}
+
+// matchSeparator reads the rest of the separator once its first rune
+// has been read, reporting whether it was all there. A partial match
+// that breaks off may be followed by the start of another, such as
+// the second ':' of ":::=" for "::=", so matching carries on from the
+// longest run of text read that could still begin the separator. The
+// runes of a partial match are left in the token buffer, but a rune
+// that can't begin the separator is unread.
+func (l *Lexer) matchSeparator() bool {
+	_, size := utf8.DecodeRuneInString(l.Separator)
+	matched := l.Separator[:size]
+	for matched != l.Separator {
+		r, err := l.next()
+		if err != nil {
+			return false
+		}
+
+		matched += string(r)
+		for !strings.HasPrefix(l.Separator, matched) {
+			_, size := utf8.DecodeRuneInString(matched)
+			matched = matched[size:]
+		}
+		if matched == "" {
+			l.backup()
+			return false
+		}
+	}
+
+	return true
+}
+
+// acceptKey emits the key held in the token buffer once its trailing
+// separator has been read, and moves on to the value
+func (l *Lexer) acceptKey(quoted bool) stateFn {
+	buf := l.bufferText()
+	key := buf[:len(buf)-len(l.Separator)]
+	keyEnd := l.Position - int64(len(l.Separator))
+
+	l.appendValue = l.AllowAppend && bytes.HasSuffix(key, []byte("+"))
+	if l.appendValue {
+		key = key[:len(key)-1]
+		keyEnd--
+	}
+
+	name := bytes.TrimRightFunc(key, l.isSpace)
+	if len(name) == 0 {
+		return l.errorLine("empty key")
+	}
+	if l.KeyValidator != nil {
+		validate := name
+		if quoted {
+			validate = name[1 : len(name)-1]
 		}
+		if err := l.KeyValidator(string(validate)); err != nil {
+			return l.errorLine(err.Error())
+		}
+	}
+
+	l.separator = append(l.separator[:0], buf[len(name):len(buf)-len(l.Separator)]...)
+	l.tokenValBuffer.Truncate(len(key))
+	l.emitSpan(ItemKey, keyEnd)
+
+	// hand the separator on to lexValue as if it had just been read
+	l.start -= int64(len(l.Separator))
+	for _, r := range l.Separator {
+		l.tokenValBuffer.WriteRune(r)
 	}
+	return lexValue
 }
 
 func lexValue(l *Lexer) stateFn {
-	l.skipWhitespace()
-	l.resetTokenBuffer()
+	start := l.start
+	skipped := l.skipRunes(l.isLineSpace)
+	l.separator = append(l.separator, skipped...)
+	if l.appendValue && l.EmitWhitespace {
+		// the '+' was dropped from the key but isn't part of the
+		// skipped text either
+		start--
+		skipped = append([]byte("+"), skipped...)
+	}
+	l.emitWhitespace(start, skipped)
+
+	if l.Heredocs {
+		if n, _ := l.takeRunes('<', 2); n == 2 {
+			return lexHeredoc
+		}
+	}
+
+	return lexValueText
+}
 
+func lexValueText(l *Lexer) stateFn {
 	var r rune
 	var err error
 
@@ -209,8 +1074,31 @@ func lexValue(l *Lexer) stateFn {
 				l.backup()
 				return lexQuotedValue(r, l)
 			}
+		case '\\':
+			if l.CommentEscapes {
+				r, err = l.next()
+				if err == nil && r == '#' {
+					// drop the backslash
+					l.tokenValBuffer.Truncate(l.tokenValBuffer.Len() - 2)
+					l.tokenValBuffer.WriteRune(r)
+				} else if err == nil {
+					l.backup()
+				}
+			}
+		case '#':
+			if l.InlineValueComments {
+				value := l.tokenValBuffer.String()
+				value = value[:len(value)-1]
+				if prev, _ := utf8.DecodeLastRuneInString(value); value == "" || l.isSpace(prev) {
+					l.backup()
+					return l.acceptInlineComment()
+				}
+			}
 		case '\n':
 			l.backup()
+			if l.IndentContinuation {
+				return lexValueContinuation
+			}
 			l.emit(ItemValue)
 			l.next()
 			return lexGeneric
@@ -218,14 +1106,119 @@ func lexValue(l *Lexer) stateFn {
 	}
 }
 
+// acceptInlineComment emits the value in the token buffer, less its
+// trailing whitespace, and moves on to the comment following it
+func (l *Lexer) acceptInlineComment() stateFn {
+	value := l.bufferText()
+	trimmed := bytes.TrimRightFunc(value, l.isSpace)
+	// escapes may have shortened the buffer, so work back from the end
+	valueEnd := l.Position - int64(len(value)-len(trimmed))
+
+	l.tokenValBuffer.Truncate(len(trimmed))
+	l.emitSpan(ItemValue, valueEnd)
+	l.emitWhitespace(valueEnd, value[len(trimmed):])
+	return lexComment
+}
+
+// lexValueContinuation looks past the newline ending a value. If the
+// next line is indented further than the value's key, the value
+// carries on through that line. Otherwise the value is emitted without
+// the newline and indentation that were read ahead.
+func lexValueContinuation(l *Lexer) stateFn {
+	valueEnd := l.Position
+	valueLen := l.tokenValBuffer.Len()
+
+	l.next() // newline
+
+	var indent int64
+	for {
+		r, err := l.next()
+		if err != nil {
+			break
+		}
+
+		if r != ' ' && r != '\t' {
+			l.backup()
+			if r != '\n' && r != '\r' && indent > l.keyColumn {
+				return lexValueText
+			}
+			break
+		}
+
+		indent++
+	}
+
+	// emitting the value doesn't write to the token buffer, so what was
+	// read ahead is still there after it
+	readAhead := l.bufferText()[valueLen:]
+	l.tokenValBuffer.Truncate(valueLen)
+	l.emitSpan(ItemValue, valueEnd)
+	l.emitWhitespace(valueEnd, readAhead)
+	return lexGeneric
+}
+
+// lexHeredoc reads the marker following "<<" and then every line up
+// to a line consisting of only that marker. If "<<" isn't followed by a
+// marker and a newline, the value is lexed as ordinary text.
+func lexHeredoc(l *Lexer) stateFn {
+	var marker strings.Builder
+	for {
+		r, err := l.next()
+		if err != nil {
+			return lexValueText
+		}
+
+		if r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r) {
+			marker.WriteRune(r)
+			continue
+		}
+
+		l.backup()
+		if (r != '\n' && r != '\r') || marker.Len() == 0 {
+			return lexValueText
+		}
+		break
+	}
+
+	var line strings.Builder
+	for {
+		r, err := l.next()
+		if err != nil {
+			if strings.TrimSpace(line.String()) == marker.String() {
+				l.emit(ItemValue)
+				l.emit(ItemEOF)
+				return nil
+			}
+
+			l.errorf("unterminated heredoc, expected %s", marker.String())
+			l.emit(ItemEOF)
+			return nil
+		}
+
+		if r == '\n' {
+			if strings.TrimSpace(line.String()) == marker.String() {
+				l.backup()
+				l.emit(ItemValue)
+				l.next()
+				return lexGeneric
+			}
+
+			line.Reset()
+			continue
+		}
+
+		line.WriteRune(r)
+	}
+}
+
 func lexQuotedValue(quoteRune rune, l *Lexer) stateFn {
 	var err error
 
 	l.resetTokenBuffer()
 
 	numQuotes, err := l.takeRunes(quoteRune, 3)
-	if err != nil {
-		l.emit(ItemError)
+	if err != nil && numQuotes != 2 {
+		l.errorf("unterminated quoted value")
 		l.emit(ItemEOF)
 		return nil
 	}
@@ -233,30 +1226,82 @@ func lexQuotedValue(quoteRune rune, l *Lexer) stateFn {
 	switch numQuotes {
 	case 1, 3:
 		for {
-			endQuotes, err := l.takeRunes(quoteRune, numQuotes)
+			// only a quote can begin the closing run, so every other
+			// rune is consumed as-is rather than read, unread, and read
+			// again by takeRunes
+			r, err := l.next()
 			if err != nil {
-				l.emit(ItemError)
+				l.errorf("unterminated quoted value")
 				l.emit(ItemEOF)
 				return nil
 			}
-			if endQuotes == numQuotes {
-				l.emit(ItemValue)
+			if r == '\n' && numQuotes == 1 && !l.MultilineQuotes {
+				l.backup()
+				l.errorf("unterminated quoted value")
 				return lexGeneric
 			}
+			if r != quoteRune {
+				continue
+			}
 
-			_, err = l.next()
-			if err != io.EOF {
-				l.emit(ItemError)
+			endQuotes, err := l.takeRunes(quoteRune, numQuotes-1)
+			if err != nil {
+				l.errorf("unterminated quoted value")
 				l.emit(ItemEOF)
 				return nil
 			}
+			if endQuotes+1 == numQuotes {
+				return lexAfterQuotedValue
+			}
+		}
+	case 2:
+		// an empty string, as long as nothing follows the closing quote
+		r, err := l.next()
+		if err == nil {
+			l.backup()
+		}
+		if err != nil || r == '\n' || r == ',' || l.isLineSpace(r) {
+			return lexAfterQuotedValue
 		}
+		return l.errorLine("mismatched quotes")
 	default:
-		l.emit(ItemError)
-		return lexGeneric
+		return l.errorLine("mismatched quotes")
 	}
 }
 
+// lexAfterQuotedValue looks past the closing quotes of a value. A
+// comma following them makes the value a list, which carries on as an
+// unquoted value would, so that `"a", "b"` is a single value. Otherwise the
+// value ends at its closing quotes.
+func lexAfterQuotedValue(l *Lexer) stateFn {
+	valueEnd := l.Position
+	valueLen := l.tokenValBuffer.Len()
+
+	for {
+		r, err := l.next()
+		if err != nil {
+			break
+		}
+
+		if r == ',' {
+			// the rest of the list is lexed as an unquoted value
+			return lexValueText
+		}
+		if !l.isLineSpace(r) {
+			l.backup()
+			break
+		}
+	}
+
+	// emitting the value doesn't write to the token buffer, so what was
+	// read ahead is still there after it
+	readAhead := l.bufferText()[valueLen:]
+	l.tokenValBuffer.Truncate(valueLen)
+	l.emitSpan(ItemValue, valueEnd)
+	l.emitWhitespace(valueEnd, readAhead)
+	return lexGeneric
+}
+
 func lexSingleQuote(l *Lexer) stateFn {
 	return lexQuotedValue('\'', l)
 }
@@ -283,42 +1328,32 @@ func (l *Lexer) acceptRun(accept rune) (numRunes int, err error) {
 	}
 }
 
-func (l *Lexer) handleUnexpectedEOF(n int) {
-	if l.Position == l.start {
-		l.emit(ItemError)
-		l.Position += int64(n)
-		l.emit(ItemEOF)
-	}
+func lexComment(l *Lexer) stateFn {
+	l.resetTokenBuffer()
+	return lexCommentRest(l)
 }
 
-func lexComment(l *Lexer) stateFn {
+// lexCommentRest reads the rest of a comment, the opening of which may
+// already be in the token buffer
+func lexCommentRest(l *Lexer) stateFn {
 	var r rune
-	var n int
 	var err error
 
-	l.start = l.Position
 	for {
-		r, n, err = l.input.ReadRune()
-		if err == io.EOF {
+		r, err = l.next()
+		if err != nil {
 			if l.Position != l.start {
 				l.emit(ItemComment)
 			}
 			l.emit(ItemEOF)
 			return nil
-		} else if err != nil {
-			l.emit(ItemError)
-			panic(err)
 		}
 
-		switch r {
-		case '\n':
-			if l.Position != l.start {
-				l.emit(ItemComment)
-			}
-			l.Position += int64(n)
+		if r == '\n' {
+			l.backup()
+			l.emit(ItemComment)
+			l.next()
 			return lexGeneric
-		default:
-			l.consumeRune(r, n)
 		}
 	}
 }
@@ -330,104 +1365,526 @@ func lexSection(l *Lexer) stateFn {
 
 	l.resetTokenBuffer()
 
-	sectionDepth, err = l.acceptRun('[')
+	if l.IndentBasedNesting {
+		var ok bool
+		if l.indentDepth, ok = l.headerIndentDepth(); !ok {
+			return l.errorLine("inconsistent indentation of section header")
+		}
+	}
+
+	sectionDepth, err = l.acceptRun(l.SectionOpen)
 	if sectionDepth == 0 || err != nil {
-		l.emit(ItemError)
+		l.errorf("unterminated section header")
 		return lexGeneric
 	}
 
 	var endSectionRun int
 	for {
-		endSectionRun, err = l.takeRunes(']', sectionDepth)
+		r, err = l.next()
 		if err != nil {
-			l.emit(ItemError)
+			if l.RecoverSections {
+				return l.recoverSection(sectionDepth)
+			}
+			l.errorf("unterminated section header")
 			l.emit(ItemEOF)
 			return nil
 		}
-		if endSectionRun == sectionDepth {
-			l.emit(ItemSection)
-			return lexGeneric
-		}
 
-		r, err = l.next()
-		if err != nil {
-			l.emit(ItemError)
-			l.emit(ItemEOF)
-			return nil
+		if r == l.SectionClose {
+			// the rune following a partial run is never a close, so it
+			// is left for the top of the loop
+			endSectionRun, err = l.takeRunes(l.SectionClose, sectionDepth-1)
+			if err != nil {
+				l.errorf("unterminated section header")
+				l.emit(ItemEOF)
+				return nil
+			}
+			if endSectionRun+1 == sectionDepth {
+				end, headerLen := l.Position, l.tokenValBuffer.Len()
+
+				var comment string
+				if l.InlineSectionComments && !l.CommentsAtLineStartOnly {
+					comment = l.inlineComment()
+				}
+
+				l.tokenValBuffer.Truncate(headerLen)
+				l.emitSection(sectionDepth, true, end, comment)
+				return lexAfterSection
+			}
+			continue
 		}
 
 		if r == '\n' {
-			l.emit(ItemError)
+			if l.RecoverSections {
+				l.backup()
+				return l.recoverSection(sectionDepth)
+			}
+			l.errorf("unterminated section header")
 			return lexGeneric
 		}
+
+		if r == '\\' && l.SectionEscapes {
+			r, err = l.next()
+			if err != nil {
+				l.errorf("unterminated section header")
+				l.emit(ItemEOF)
+				return nil
+			}
+
+			switch r {
+			case l.SectionOpen, l.SectionClose:
+				if l.DecodeSectionEscapes {
+					// drop the backslash
+					l.tokenValBuffer.Truncate(l.tokenValBuffer.Len() - 2)
+					l.tokenValBuffer.WriteRune(r)
+				}
+			default:
+				l.backup()
+			}
+		}
+	}
+}
+
+// lexAfterSection checks that nothing but whitespace or a comment
+// follows a section header on its line
+func lexAfterSection(l *Lexer) stateFn {
+	start := l.start
+	if l.emitWhitespace(start, l.skipRunes(l.isLineSpace)) {
+		// leave room in the step for an error and EOF
+		return lexAfterSection
+	}
+
+	r, err := l.next()
+	if err != nil {
+		return lexGeneric
+	}
+
+	switch {
+	case r == '\n':
+		l.backup()
+		return lexGeneric
+	case r == '#' && !l.CommentsAtLineStartOnly:
+		l.backup()
+		return lexComment
+	case r == '/' && l.SlashComments && !l.CommentsAtLineStartOnly && l.slashComment():
+		return lexCommentRest
+	default:
+		return l.errorLine("unexpected text after section header")
+	}
+}
+
+// slashComment reports whether the '/' just read begins a "//"
+// comment, consuming the second '/' if so
+func (l *Lexer) slashComment() bool {
+	r, err := l.next()
+	if err != nil {
+		return false
+	}
+	if r != '/' {
+		l.backup()
+		return false
+	}
+
+	return true
+}
+
+// headerIndentDepth works out the depth of the section header starting
+// at the current position from its indentation. The first indented
+// header fixes the unit of indentation. It reports false if the header
+// isn't indented by a whole number of units, or is indented more than
+// one unit deeper than the enclosing section.
+func (l *Lexer) headerIndentDepth() (int, bool) {
+	column := l.Position - l.lineStart
+	if column > int64(len(l.lineText)) {
+		return 0, false
+	}
+
+	indent := string(l.lineText[:column])
+	if indent == "" {
+		return 1, true
 	}
+
+	unit := l.indentUnit
+	if unit == "" {
+		unit = indent
+	}
+
+	units := len(indent) / len(unit)
+	if indent != strings.Repeat(unit, units) || units > len(l.sectionStack) {
+		return 0, false
+	}
+
+	l.indentUnit = unit
+	return units + 1, true
+}
+
+// recoverSection reports the unterminated header in the token buffer
+// and then emits it as a section, as though it had been closed
+func (l *Lexer) recoverSection(depth int) stateFn {
+	closers := strings.Repeat(string(l.SectionClose), depth)
+	l.send(l.errorToken(fmt.Sprintf("unterminated section header, assuming %s", closers)))
+	l.emitSection(depth, false, l.Position, "")
+	return lexGeneric
+}
+
+// send queues t for NextItem, keeping count of it in the lexer's Stats
+func (l *Lexer) send(t Token) {
+	switch t.TokenType {
+	case ItemSection:
+		l.stats.Sections++
+	case ItemKey:
+		l.stats.Keys++
+	case ItemComment:
+		l.stats.Comments++
+	case ItemError:
+		l.stats.Errors++
+	}
+	if t.TokenType != ItemWhitespace && t.TokenType != ItemEOF {
+		l.lastEnd = t.End()
+	}
+
+	l.tokenStream <- t
 }
 
 func (l *Lexer) emit(t itemType) {
-	l.tokenStream <- Token{
+	l.emitSpan(t, l.Position)
+}
+
+// emitSpan emits a token ending at end, which may be behind the
+// current position when the lexer has read ahead of the token
+func (l *Lexer) emitSpan(t itemType, end int64) {
+	tok := Token{
 		TokenType: t,
 		Position:  l.start,
+		Len:       end - l.start,
+	}
+	if l.borrow {
+		// NextView hands out the text from the arena, see TokenView
+		text := l.bufferText()
+		if t == ItemValue && l.TrimValues {
+			text = bytes.TrimFunc(text, l.isSpace)
+		}
+		tok.sepStart = len(l.arena)
+		if t == ItemValue {
+			l.arena = append(l.arena, l.separator...)
+		}
+		l.lend(&tok, text)
+	} else {
+		tok.Value = l.tokenValBuffer.String()
+		if t == ItemValue && l.TrimValues {
+			tok.Value = strings.TrimFunc(tok.Value, l.isSpace)
+		}
+		if t == ItemValue {
+			tok.Separator = string(l.separator)
+		}
+	}
+	if t == ItemValue {
+		tok.Append = l.appendValue
+	}
+	if t == ItemKey {
+		l.keySection = l.sectionStack
+	}
+	if t == ItemComment {
+		tok.Inline = l.lastEnd > l.lineStart
+	}
+	l.send(tok)
+
+	l.resetTokenBuffer()
+}
+
+// lend copies text into the arena for tok to borrow
+func (l *Lexer) lend(tok *Token, text []byte) {
+	tok.borrowed = true
+	tok.textStart = len(l.arena)
+	l.arena = append(l.arena, text...)
+	tok.textEnd = len(l.arena)
+}
+
+// bufferText returns the contents of the token buffer, without a copy
+// if the buffer can lend its bytes. They are only valid until the
+// buffer is next written to.
+func (l *Lexer) bufferText() []byte {
+	if b, ok := l.tokenValBuffer.(interface{ Bytes() []byte }); ok {
+		return b.Bytes()
+	}
+	return []byte(l.tokenValBuffer.String())
+}
+
+// emitSection emits the header in the token buffer, which is enclosed
+// by runs of brackets delimiters. If closed is false the header is
+// missing its close delimiters and runs to end.
+func (l *Lexer) emitSection(brackets int, closed bool, end int64, comment string) {
+	value := l.bufferText()
+	nameEnd := len(value)
+	if closed {
+		nameEnd -= brackets * utf8.RuneLen(l.SectionClose)
+	}
+	nameText := bytes.TrimSpace(value[brackets*utf8.RuneLen(l.SectionOpen) : nameEnd])
+
+	depth := brackets
+	if l.IndentBasedNesting {
+		depth = l.indentDepth
+	}
+
+	var name string
+	if depth <= len(l.sectionStack) && string(nameText) == l.sectionStack[depth-1] {
+		// reuse the copy already on the stack
+		name = l.sectionStack[depth-1]
+	} else {
+		name = string(nameText)
+	}
+
+	if l.OnSection != nil {
+		if err := l.OnSection(depth, name); err != nil {
+			t := l.errorToken(err.Error())
+			t.Len = end - l.start
+			l.send(t)
+			l.resetTokenBuffer()
+			return
+		}
+	}
+	tok := Token{
+		TokenType: ItemSection,
+		Position:  l.start,
+		Len:       end - l.start,
+		Depth:     depth,
+		Name:      name,
+		Comment:   comment,
+	}
+	if l.borrow {
+		l.lend(&tok, value)
+	} else {
+		tok.Value = string(value)
+	}
+	l.send(tok)
+
+	parents := l.sectionStack
+	for len(parents) < depth-1 {
+		parents = append(parents, "")
+	}
+	l.sectionStack = append(parents[:depth-1], name)
+	l.keySection = l.sectionStack
+
+	l.resetTokenBuffer()
+}
+
+// inlineComment consumes a comment that follows optional whitespace on
+// the current line, returning its text. Nothing but whitespace is
+// consumed if the rest of the line isn't a comment.
+func (l *Lexer) inlineComment() string {
+	for {
+		r, err := l.next()
+		if err != nil {
+			return ""
+		}
+
+		if r == '#' {
+			break
+		}
+		if !l.isLineSpace(r) {
+			l.backup()
+			return ""
+		}
+	}
+
+	commentStart := l.tokenValBuffer.Len() - 1
+	for {
+		r, err := l.next()
+		if err != nil {
+			break
+		}
+
+		if r == '\n' {
+			l.backup()
+			break
+		}
+	}
+
+	return l.tokenValBuffer.String()[commentStart:]
+}
+
+// errorf emits an ItemError token spanning the current token buffer
+func (l *Lexer) errorf(format string, args ...interface{}) {
+	l.send(l.errorToken(fmt.Sprintf(format, args...)))
+	l.resetTokenBuffer()
+}
+
+func (l *Lexer) errorToken(msg string) Token {
+	t := Token{
+		TokenType: ItemError,
+		Position:  l.start,
 		Len:       l.Position - l.start,
 		Value:     l.tokenValBuffer.String(),
+		Message:   msg,
 	}
 
-	l.resetTokenBuffer()
+	line, lineStart, lineNo := l.lineText, l.lineStart, l.line
+	if l.start < lineStart {
+		line, lineStart, lineNo = l.prevLineText, l.prevLineStart, lineNo-1
+	}
+	if column := l.start - lineStart; column >= 0 {
+		t.Column = int(column)
+		// the line is only kept up to maxContextBytes
+		if column <= int64(len(line)) {
+			t.Context = string(line)
+		}
+	}
+	t.Filename = l.Filename
+	t.Line = lineNo + 1
+
+	return t
+}
+
+// errorLine consumes the rest of the current line into an ItemError
+// token so that lexing resumes on the next line rather than producing
+// a cascade of errors from the remains of a malformed line
+func (l *Lexer) errorLine(msg string) stateFn {
+	for {
+		r, err := l.next()
+		if err != nil {
+			l.errorf("%s", msg)
+			l.emit(ItemEOF)
+			return nil
+		}
+
+		if r == '\n' {
+			l.backup()
+			l.errorf("%s", msg)
+			return lexGeneric
+		}
+	}
+}
+
+func (l *Lexer) skipWhitespace() []byte {
+	return l.skipRunes(l.isSpace)
+}
+
+// emitWhitespace emits ws, which began at start, as an ItemWhitespace
+// token if EmitWhitespace is set, reporting whether it did
+func (l *Lexer) emitWhitespace(start int64, ws []byte) bool {
+	if !l.EmitWhitespace || len(ws) == 0 {
+		return false
+	}
+
+	l.send(Token{
+		TokenType: ItemWhitespace,
+		Position:  start,
+		Len:       int64(len(ws)),
+		Value:     string(ws),
+	})
+	return true
 }
 
-func (l *Lexer) skipWhitespace() {
+// skipRunes consumes runes for as long as accept returns true, and
+// returns the contents of the token buffer up to the first rejected
+// rune, which like bufferText are only valid until the buffer is next
+// written to
+func (l *Lexer) skipRunes(accept func(rune) bool) []byte {
 	var r rune
 	var err error
 
 	for {
 		r, err = l.next()
 		if err != nil {
-			if err == io.EOF {
-				return
-			}
-			panic(err)
+			break
 		}
 
-		if !unicode.IsSpace(r) {
+		if !accept(r) {
 			l.backup()
-			l.resetTokenBuffer()
-			return
+			break
 		}
 	}
+
+	skipped := l.bufferText()
+	l.resetTokenBuffer()
+	return skipped
+}
+
+// isSpace reports whether r is whitespace, restricted to ASCII
+// whitespace when ASCIIWhitespaceOnly is set
+func (l *Lexer) isSpace(r rune) bool {
+	if l.ASCIIWhitespaceOnly {
+		return r == ' ' || r == '\t' || r == '\r' || r == '\n'
+	}
+	return unicode.IsSpace(r)
+}
+
+// isLineSpace reports whether r is whitespace that does not end a line
+func (l *Lexer) isLineSpace(r rune) bool {
+	return r != '\n' && l.isSpace(r)
 }
 
 func (l *Lexer) consumeRune(r rune, n int) {
 	l.Position += int64(n)
 	l.tokenValBuffer.WriteRune(r)
+
+	if r == '\n' {
+		l.markLineStart()
+	} else if len(l.lineText)+n <= maxContextBytes {
+		if r == utf8.RuneError && n == 1 {
+			// keep the line's length in step with the input's
+			l.lineText = append(l.lineText, '?')
+		} else {
+			l.lineText = utf8.AppendRune(l.lineText, r)
+		}
+	}
+}
+
+func (l *Lexer) markLineStart() {
+	l.prevLineStart = l.lineStart
+	l.lineStart = l.Position
+	l.line++
+	l.prevLineText, l.lineText = l.lineText, l.prevLineText[:0]
 }
 
 func (l *Lexer) next() (r rune, err error) {
 	var size int
 	r, size, err = l.input.ReadRune()
 	if err != io.EOF && err != nil {
-		l.emit(ItemError)
-		panic(err)
+		panic(readError{err})
 	}
 
-	l.consumeRune(r, size)
 	l.prevRuneSize = size
+	if err == nil {
+		l.consumeRune(r, size)
+	}
+
+	if l.MaxTokenBytes > 0 && l.tokenValBuffer.Len() > l.MaxTokenBytes {
+		panic(errTokenTooLarge)
+	}
 
 	return
 }
 
 func (l *Lexer) backup() {
 	if l.prevRuneSize == 0 {
-		panic("backup called before a call to next")
+		panic(errDoubleBackup)
 	}
 
 	err := l.input.UnreadRune()
 	if err != nil {
-		l.emit(ItemError)
-		panic(err)
+		panic(readError{err})
 	}
 
-	l.tokenValBuffer.Truncate(l.tokenValBuffer.Len() - l.prevRuneSize)
+	if l.Position-int64(l.prevRuneSize) < l.start {
+		// the rune was read before the token buffer was last reset, so
+		// it isn't in the buffer and the token now starts with it
+		l.start = l.Position - int64(l.prevRuneSize)
+	} else {
+		l.tokenValBuffer.Truncate(l.tokenValBuffer.Len() - l.prevRuneSize)
+	}
 	l.Position -= int64(l.prevRuneSize)
 	l.prevRuneSize = 0
+
+	if l.Position < l.lineStart {
+		l.lineStart = l.prevLineStart
+		l.line--
+		// the arrays are swapped back by the next markLineStart
+		l.lineText, l.prevLineText = l.prevLineText, l.lineText[:0]
+	}
+	if n := l.Position - l.lineStart; n < int64(len(l.lineText)) {
+		l.lineText = l.lineText[:n]
+	}
 }
 
 func (l *Lexer) resetTokenBuffer() {
@@ -1,14 +1,24 @@
 package modconfigobj_test
 
 import (
+	"bytes"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
+	"unicode"
 
 	"github.com/christian-blades-cb/modconfigobj"
 )
 
+var update = flag.Bool("update", false, "rewrite the .golden files in testdata")
+
 const SimpleFile = `
 [section]
 key = value
@@ -47,3 +57,1835 @@ func Test_SimpleFile(t *testing.T) {
 		}
 	}
 }
+
+func FuzzLexer(f *testing.F) {
+	f.Add([]byte(SimpleFile))
+	f.Add([]byte("# comment\nkey = value\n"))
+	f.Add([]byte("[a]\n[[b]]\nkey = \"quoted\"\nother = '''triple'''\n"))
+	f.Add([]byte("=\n[unterminated\nkey\n"))
+
+	f.Fuzz(func(t *testing.T, src []byte) {
+		lex := modconfigobj.NewLexer(bytes.NewReader(src))
+
+		// every token consumes at least one byte, save for errors and the final EOF
+		maxTokens := 2*len(src) + 2
+		for i := 0; ; i++ {
+			if i > maxTokens {
+				t.Fatalf("lexer did not reach EOF within %d tokens", maxTokens)
+			}
+
+			tok := lex.NextItem()
+			if lex.Position > int64(len(src)) {
+				t.Fatalf("position %d exceeds input length %d", lex.Position, len(src))
+			}
+			if tok.Position < 0 || tok.Len < 0 || tok.Position+tok.Len > int64(len(src)) {
+				t.Fatalf("%v spans outside of input (len %d)", tok, len(src))
+			}
+			if tok.TokenType == modconfigobj.ItemEOF {
+				return
+			}
+		}
+	})
+}
+
+func Test_SectionDepthAndName(t *testing.T) {
+	cases := []struct {
+		src   string
+		depth int
+		name  string
+	}{
+		{"[a]", 1, "a"},
+		{"[[b]]", 2, "b"},
+		{"[[ b ]]", 2, "b"},
+		{"[[[ deeply nested ]]]\n", 3, "deeply nested"},
+	}
+
+	for _, c := range cases {
+		lex := modconfigobj.NewLexer(strings.NewReader(c.src))
+		tok := lex.NextItem()
+		if tok.TokenType != modconfigobj.ItemSection {
+			t.Fatalf("%q: expected a section token, got %v", c.src, tok)
+		}
+		if tok.Depth != c.depth {
+			t.Errorf("%q: expected depth %d, got %d", c.src, c.depth, tok.Depth)
+		}
+		if tok.Name != c.name {
+			t.Errorf("%q: expected name %q, got %q", c.src, c.name, tok.Name)
+		}
+	}
+}
+
+func Test_IndentContinuation(t *testing.T) {
+	cases := []struct {
+		name string
+		src  string
+		want []modconfigobj.Token
+	}{
+		{
+			name: "two-line value",
+			src:  "[s]\n  key = first\n    second\n",
+			want: []modconfigobj.Token{
+				{TokenType: modconfigobj.ItemSection, Value: "[s]"},
+				{TokenType: modconfigobj.ItemKey, Value: "key "},
+				{TokenType: modconfigobj.ItemValue, Value: "first\n    second"},
+				{TokenType: modconfigobj.ItemEOF},
+			},
+		},
+		{
+			name: "dedented line ends the value",
+			src:  "  key = first\n    second\nother = value\n",
+			want: []modconfigobj.Token{
+				{TokenType: modconfigobj.ItemKey, Value: "key "},
+				{TokenType: modconfigobj.ItemValue, Value: "first\n    second"},
+				{TokenType: modconfigobj.ItemKey, Value: "other "},
+				{TokenType: modconfigobj.ItemValue, Value: "value"},
+				{TokenType: modconfigobj.ItemEOF},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		lex := modconfigobj.NewLexer(strings.NewReader(c.src))
+		lex.IndentContinuation = true
+
+		for _, w := range c.want {
+			tok := lex.NextItem()
+			if tok.TokenType != w.TokenType || tok.Value != w.Value {
+				t.Fatalf("%s: expected %s %q, got %v", c.name, w.TokenType, w.Value, tok)
+			}
+			if tok.Value != c.src[tok.Position:tok.Position+tok.Len] {
+				t.Errorf("%s: %v does not match its source span", c.name, tok)
+			}
+		}
+	}
+}
+
+func Test_TokenAt(t *testing.T) {
+	const src = "[s]\nkey = value\n"
+
+	var tokens []modconfigobj.Token
+	lex := modconfigobj.NewLexer(strings.NewReader(src))
+	for tok := lex.NextItem(); tok.TokenType != modconfigobj.ItemEOF; tok = lex.NextItem() {
+		tokens = append(tokens, tok)
+	}
+
+	cases := []struct {
+		offset int64
+		found  bool
+		value  string
+	}{
+		{0, true, "[s]"},    // start of a token
+		{1, true, "[s]"},    // middle of a token
+		{2, true, "[s]"},    // last byte of a token
+		{3, false, ""},      // newline after the section
+		{4, true, "key "},   // start of the key
+		{8, false, ""},      // separator between key and value
+		{9, false, ""},      // whitespace between key and value
+		{14, true, "value"}, // last byte of the value
+		{15, false, ""},     // trailing newline
+		{int64(len(src)), false, ""},
+	}
+
+	for _, c := range cases {
+		tok, ok := modconfigobj.TokenAt(tokens, c.offset)
+		if ok != c.found {
+			t.Errorf("offset %d: expected found=%t, got %t (%v)", c.offset, c.found, ok, tok)
+			continue
+		}
+		if ok && tok.Value != c.value {
+			t.Errorf("offset %d: expected %q, got %q", c.offset, c.value, tok.Value)
+		}
+	}
+}
+
+func Test_CommentPosition(t *testing.T) {
+	const first = "key = value\n"
+	const comment = "# héllo wörld"
+	src := first + "  " + comment + "\n" + comment
+
+	lex := modconfigobj.NewLexer(strings.NewReader(src))
+	var comments []modconfigobj.Token
+	for tok := lex.NextItem(); tok.TokenType != modconfigobj.ItemEOF; tok = lex.NextItem() {
+		if tok.TokenType == modconfigobj.ItemComment {
+			comments = append(comments, tok)
+		}
+	}
+
+	expected := []int64{
+		int64(len(first) + 2),
+		int64(len(first) + 2 + len(comment) + 1),
+	}
+	if len(comments) != len(expected) {
+		t.Fatalf("expected %d comments, got %d", len(expected), len(comments))
+	}
+	for i, c := range comments {
+		if c.Position != expected[i] {
+			t.Errorf("comment %d: expected position %d, got %d", i, expected[i], c.Position)
+		}
+		if c.Len != int64(len(comment)) {
+			t.Errorf("comment %d: expected len %d, got %d", i, len(comment), c.Len)
+		}
+		if c.Value != comment {
+			t.Errorf("comment %d: expected %q, got %q", i, comment, c.Value)
+		}
+	}
+}
+
+func benchmarkTokenBuffer(b *testing.B, size int) {
+	src := []byte(strings.Repeat("[section]\n# comment\nkey = value\nquoted = \"value\"\n[[sub]]\nother = x\n", 1000))
+
+	b.SetBytes(int64(len(src)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		lex := modconfigobj.NewLexerWithOptions(bytes.NewReader(src), modconfigobj.WithTokenBuffer(size))
+		for lex.NextItem().TokenType != modconfigobj.ItemEOF {
+		}
+	}
+}
+
+// a buffer of 1 is raised to the minimum of 2, which a single step of
+// the lexer may fill, so there is no benchmark of 1
+func BenchmarkTokenBuffer2(b *testing.B)  { benchmarkTokenBuffer(b, 2) }
+func BenchmarkTokenBuffer3(b *testing.B)  { benchmarkTokenBuffer(b, 3) }
+func BenchmarkTokenBuffer64(b *testing.B) { benchmarkTokenBuffer(b, 64) }
+
+func Test_WithTokenBufferMinimum(t *testing.T) {
+	// "key" emits an error and EOF from a single state, which would
+	// deadlock a one-token buffer
+	lex := modconfigobj.NewLexerWithOptions(strings.NewReader("key"), modconfigobj.WithTokenBuffer(1))
+
+	if tok := lex.NextItem(); tok.TokenType != modconfigobj.ItemError {
+		t.Errorf("expected an error token, got %v", tok)
+	}
+	if tok := lex.NextItem(); tok.TokenType != modconfigobj.ItemEOF {
+		t.Errorf("expected EOF, got %v", tok)
+	}
+}
+
+func Test_WithTokenBufferMinimumWhitespace(t *testing.T) {
+	// whitespace followed by an error and EOF must not be emitted from
+	// a single state
+	cases := []struct {
+		src      string
+		expected []string
+	}{
+		{"  =x", []string{"Whitespace", "Error", "EOF"}},
+		{"[s]  junk", []string{"Section", "Whitespace", "Error", "EOF"}},
+	}
+
+	for _, c := range cases {
+		lex := modconfigobj.NewLexerWithOptions(strings.NewReader(c.src), modconfigobj.WithTokenBuffer(2))
+		lex.EmitWhitespace = true
+
+		done := make(chan []string)
+		go func() {
+			var types []string
+			for tok := lex.NextItem(); ; tok = lex.NextItem() {
+				types = append(types, tok.TokenType.String())
+				if tok.IsEOF() {
+					break
+				}
+			}
+			done <- types
+		}()
+
+		select {
+		case got := <-done:
+			if !reflect.DeepEqual(got, c.expected) {
+				t.Errorf("%q: expected %v, got %v", c.src, c.expected, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%q: lexer deadlocked", c.src)
+		}
+	}
+}
+
+func Test_NewLexerFromReader(t *testing.T) {
+	// hide bytes.Reader's ReadRune/UnreadRune behind a plain io.Reader
+	r := struct{ io.Reader }{bytes.NewReader([]byte(SimpleFile))}
+	lex := modconfigobj.NewLexerFromReader(r)
+
+	expected := []modconfigobj.Token{
+		{TokenType: modconfigobj.ItemSection, Value: "[section]"},
+		{TokenType: modconfigobj.ItemKey, Value: "key "},
+		{TokenType: modconfigobj.ItemValue, Value: "value"},
+		{TokenType: modconfigobj.ItemEOF},
+	}
+	for _, e := range expected {
+		tok := lex.NextItem()
+		if tok.TokenType != e.TokenType || tok.Value != e.Value {
+			t.Fatalf("expected %s %q, got %v", e.TokenType, e.Value, tok)
+		}
+	}
+}
+
+func Test_ValueSeparator(t *testing.T) {
+	cases := []struct {
+		src       string
+		separator string
+		value     string
+	}{
+		{"key = value\n", " = ", "value"},
+		{"key=value\n", "=", "value"},
+		{"key   =  value\n", "   =  ", "value"},
+		{"key\t=\tvalue", "\t=\t", "value"},
+		{"key= \"quoted\"\n", "= ", "\"quoted\""},
+		{"key =\nother = value\n", " =", ""},
+	}
+
+	for _, c := range cases {
+		lex := modconfigobj.NewLexer(strings.NewReader(c.src))
+		if tok := lex.NextItem(); tok.TokenType != modconfigobj.ItemKey {
+			t.Fatalf("%q: expected a key, got %v", c.src, tok)
+		}
+
+		tok := lex.NextItem()
+		if tok.TokenType != modconfigobj.ItemValue {
+			t.Fatalf("%q: expected a value, got %v", c.src, tok)
+		}
+		if tok.Separator != c.separator {
+			t.Errorf("%q: expected separator %q, got %q", c.src, c.separator, tok.Separator)
+		}
+		if tok.Value != c.value {
+			t.Errorf("%q: expected value %q, got %q", c.src, c.value, tok.Value)
+		}
+	}
+}
+
+func Test_SectionEscapes(t *testing.T) {
+	const src = `[a\]b]` + "\n"
+
+	cases := []struct {
+		decode bool
+		value  string
+		name   string
+	}{
+		{false, `[a\]b]`, `a\]b`},
+		{true, `[a]b]`, `a]b`},
+	}
+
+	for _, c := range cases {
+		lex := modconfigobj.NewLexer(strings.NewReader(src))
+		lex.SectionEscapes = true
+		lex.DecodeSectionEscapes = c.decode
+
+		tok := lex.NextItem()
+		if tok.TokenType != modconfigobj.ItemSection {
+			t.Fatalf("decode=%t: expected a section, got %v", c.decode, tok)
+		}
+		if tok.Value != c.value || tok.Name != c.name {
+			t.Errorf("decode=%t: expected value %q and name %q, got %q and %q", c.decode, c.value, c.name, tok.Value, tok.Name)
+		}
+		if tok.Len != int64(len(src)-1) {
+			t.Errorf("decode=%t: expected len %d, got %d", c.decode, len(src)-1, tok.Len)
+		}
+		if tok := lex.NextItem(); tok.TokenType != modconfigobj.ItemEOF {
+			t.Errorf("decode=%t: expected EOF, got %v", c.decode, tok)
+		}
+	}
+}
+
+func Test_SectionEscapesDisabled(t *testing.T) {
+	lex := modconfigobj.NewLexer(strings.NewReader(`[a\]b]` + "\n"))
+
+	if tok := lex.NextItem(); tok.TokenType != modconfigobj.ItemSection || tok.Value != `[a\]` {
+		t.Errorf(`expected section "[a\]", got %v`, tok)
+	}
+}
+
+// lexAll drains the lexer, returning every token up to and including EOF
+func lexAll(src string) []modconfigobj.Token {
+	var tokens []modconfigobj.Token
+
+	lex := modconfigobj.NewLexer(strings.NewReader(src))
+	for {
+		tok := lex.NextItem()
+		tokens = append(tokens, tok)
+		if tok.TokenType == modconfigobj.ItemEOF {
+			return tokens
+		}
+	}
+}
+
+func Test_EmptySections(t *testing.T) {
+	cases := []struct {
+		name string
+		src  string
+		want []string
+	}{
+		{
+			name: "empty trailing section",
+			src:  "[a]\nkey = value\n[empty]\n",
+			want: []string{"Section [a]", "Keyword key ", "Value value", "Section [empty]", "EOF "},
+		},
+		{
+			name: "empty trailing section without newline",
+			src:  "[a]\nkey = value\n[empty]",
+			want: []string{"Section [a]", "Keyword key ", "Value value", "Section [empty]", "EOF "},
+		},
+		{
+			name: "empty middle section",
+			src:  "[empty]\n[b]\nkey = value\n",
+			want: []string{"Section [empty]", "Section [b]", "Keyword key ", "Value value", "EOF "},
+		},
+		{
+			name: "comment-only section",
+			src:  "[s]\n# only a comment\n[t]\nkey = value\n",
+			want: []string{"Section [s]", "Comment # only a comment", "Section [t]", "Keyword key ", "Value value", "EOF "},
+		},
+	}
+
+	for _, c := range cases {
+		var got []string
+		for _, tok := range lexAll(c.src) {
+			got = append(got, tok.TokenType.String()+" "+tok.Value)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: expected %q, got %q", c.name, c.want, got)
+		}
+	}
+}
+
+func Test_AppendOperator(t *testing.T) {
+	const src = "x = a\nx += b\ny+=c\n"
+
+	lex := modconfigobj.NewLexer(strings.NewReader(src))
+	lex.AllowAppend = true
+
+	expected := []modconfigobj.Token{
+		{TokenType: modconfigobj.ItemKey, Value: "x "},
+		{TokenType: modconfigobj.ItemValue, Value: "a", Separator: " = "},
+		{TokenType: modconfigobj.ItemKey, Value: "x "},
+		{TokenType: modconfigobj.ItemValue, Value: "b", Separator: " += ", Append: true},
+		{TokenType: modconfigobj.ItemKey, Value: "y"},
+		{TokenType: modconfigobj.ItemValue, Value: "c", Separator: "+=", Append: true},
+		{TokenType: modconfigobj.ItemEOF},
+	}
+	for _, e := range expected {
+		tok := lex.NextItem()
+		if tok.TokenType != e.TokenType || tok.Value != e.Value || tok.Separator != e.Separator || tok.Append != e.Append {
+			t.Fatalf("expected %+v, got %+v", e, tok)
+		}
+		if tok.Value != src[tok.Position:tok.Position+tok.Len] {
+			t.Errorf("%v does not match its source span", tok)
+		}
+	}
+}
+
+func Test_AppendOperatorWithoutKey(t *testing.T) {
+	lex := modconfigobj.NewLexer(strings.NewReader("+= b\nkey = value\n"))
+	lex.AllowAppend = true
+
+	if tok := lex.NextItem(); tok.TokenType != modconfigobj.ItemError {
+		t.Errorf("expected an error, got %v", tok)
+	}
+	if tok := lex.NextItem(); tok.TokenType != modconfigobj.ItemKey || tok.Value != "key " {
+		t.Errorf("expected lexing to resume on the next line, got %v", tok)
+	}
+}
+
+func Test_AppendOperatorDisabled(t *testing.T) {
+	lex := modconfigobj.NewLexer(strings.NewReader("c+ = lang\n"))
+
+	tok := lex.NextItem()
+	if tok.TokenType != modconfigobj.ItemKey || tok.Value != "c+ " {
+		t.Fatalf(`expected key "c+ ", got %v`, tok)
+	}
+	if tok := lex.NextItem(); tok.Append {
+		t.Errorf("expected a plain value, got %+v", tok)
+	}
+}
+
+func Test_KeyValidator(t *testing.T) {
+	noSpaces := func(key string) error {
+		if strings.ContainsAny(key, " \t") {
+			return fmt.Errorf("key %q contains whitespace", key)
+		}
+		return nil
+	}
+	asciiOnly := func(key string) error {
+		for _, r := range key {
+			if r > unicode.MaxASCII {
+				return fmt.Errorf("key %q contains non-ASCII characters", key)
+			}
+		}
+		return nil
+	}
+
+	cases := []struct {
+		name      string
+		validator func(string) error
+		src       string
+		message   string
+	}{
+		{"spaces", noSpaces, "my key = value\nkey = value\n", `key "my key" contains whitespace`},
+		{"non-ASCII", asciiOnly, "clé = value\nkey = value\n", `key "clé" contains non-ASCII characters`},
+	}
+
+	for _, c := range cases {
+		lex := modconfigobj.NewLexer(strings.NewReader(c.src))
+		lex.KeyValidator = c.validator
+
+		tok := lex.NextItem()
+		if tok.TokenType != modconfigobj.ItemError || tok.Message != c.message {
+			t.Errorf("%s: expected error %q, got %+v", c.name, c.message, tok)
+		}
+
+		// the rejected line is skipped, and the valid key is accepted
+		if tok := lex.NextItem(); tok.TokenType != modconfigobj.ItemKey || tok.Value != "key " {
+			t.Errorf("%s: expected the valid key, got %v", c.name, tok)
+		}
+		if tok := lex.NextItem(); tok.TokenType != modconfigobj.ItemValue {
+			t.Errorf("%s: expected a value, got %v", c.name, tok)
+		}
+	}
+}
+
+func Test_Heredoc(t *testing.T) {
+	const heredoc = "<<END\nfirst line\n  second = line\nEND"
+	src := "[s]\nkey = " + heredoc + "\nother = value\n"
+
+	lex := modconfigobj.NewLexer(strings.NewReader(src))
+	lex.Heredocs = true
+
+	expected := []modconfigobj.Token{
+		{TokenType: modconfigobj.ItemSection, Value: "[s]"},
+		{TokenType: modconfigobj.ItemKey, Value: "key "},
+		{TokenType: modconfigobj.ItemValue, Value: heredoc},
+		{TokenType: modconfigobj.ItemKey, Value: "other "},
+		{TokenType: modconfigobj.ItemValue, Value: "value"},
+		{TokenType: modconfigobj.ItemEOF},
+	}
+	for _, e := range expected {
+		tok := lex.NextItem()
+		if tok.TokenType != e.TokenType || tok.Value != e.Value {
+			t.Fatalf("expected %s %q, got %v", e.TokenType, e.Value, tok)
+		}
+		if tok.Value != src[tok.Position:tok.Position+tok.Len] {
+			t.Errorf("%v does not match its source span", tok)
+		}
+	}
+}
+
+func Test_HeredocUnterminated(t *testing.T) {
+	lex := modconfigobj.NewLexer(strings.NewReader("key = <<END\nnever closed\n"))
+	lex.Heredocs = true
+
+	lex.NextItem() // key
+	if tok := lex.NextItem(); tok.TokenType != modconfigobj.ItemError {
+		t.Errorf("expected an error, got %v", tok)
+	}
+	if tok := lex.NextItem(); tok.TokenType != modconfigobj.ItemEOF {
+		t.Errorf("expected EOF, got %v", tok)
+	}
+}
+
+func Test_HeredocNotAMarker(t *testing.T) {
+	lex := modconfigobj.NewLexer(strings.NewReader("key = << not a heredoc\n"))
+	lex.Heredocs = true
+
+	lex.NextItem() // key
+	if tok := lex.NextItem(); tok.TokenType != modconfigobj.ItemValue || tok.Value != "<< not a heredoc" {
+		t.Errorf("expected a plain value, got %v", tok)
+	}
+}
+
+func Test_Peek(t *testing.T) {
+	lex := modconfigobj.NewLexer(strings.NewReader(SimpleFile))
+
+	first := lex.Peek()
+	if first.TokenType != modconfigobj.ItemSection {
+		t.Fatalf("expected a section, got %v", first)
+	}
+	if again := lex.Peek(); again != first {
+		t.Errorf("expected a second Peek to return %v, got %v", first, again)
+	}
+	if next := lex.NextItem(); next != first {
+		t.Errorf("expected NextItem to return the peeked %v, got %v", first, next)
+	}
+
+	if tok := lex.NextItem(); tok.TokenType != modconfigobj.ItemKey {
+		t.Errorf("expected NextItem to move past the peeked token, got %v", tok)
+	}
+	if tok := lex.Peek(); tok.TokenType != modconfigobj.ItemValue {
+		t.Errorf("expected to peek the value, got %v", tok)
+	}
+}
+
+func Test_EqualsInValue(t *testing.T) {
+	cases := []struct {
+		src  string
+		want []string
+	}{
+		{"key = a=b\n", []string{"Keyword key ", "Value a=b", "EOF "}},
+		{"url = a=b&c=d\n", []string{"Keyword url ", "Value a=b&c=d", "EOF "}},
+		{"key== x\n", []string{"Keyword key", "Value = x", "EOF "}},
+		{"=leading\nkey = value\n", []string{"Error =leading", "Keyword key ", "Value value", "EOF "}},
+	}
+
+	for _, c := range cases {
+		var got []string
+		for _, tok := range lexAll(c.src) {
+			got = append(got, tok.TokenType.String()+" "+tok.Value)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%q: expected %q, got %q", c.src, c.want, got)
+		}
+	}
+}
+
+func Test_TokenPredicates(t *testing.T) {
+	predicates := map[string]func(modconfigobj.Token) bool{
+		"Error":   modconfigobj.Token.IsError,
+		"Comment": modconfigobj.Token.IsComment,
+		"Keyword": modconfigobj.Token.IsKey,
+		"Value":   modconfigobj.Token.IsValue,
+		"Section": modconfigobj.Token.IsSection,
+		"EOF":     modconfigobj.Token.IsEOF,
+	}
+
+	tokens := lexAll("# comment\n[section]\nkey = value\nbroken\n")
+	seen := map[string]bool{}
+	for _, tok := range tokens {
+		seen[tok.TokenType.String()] = true
+		for name, is := range predicates {
+			if expected := name == tok.TokenType.String(); is(tok) != expected {
+				t.Errorf("%v: expected Is%s to be %t", tok, name, expected)
+			}
+		}
+	}
+
+	if len(seen) != len(predicates) {
+		t.Errorf("expected the fixture to produce every token type, got %v", seen)
+	}
+}
+
+func Test_TokenEnd(t *testing.T) {
+	const src = "[section]\nkey = value\n"
+
+	for _, tok := range lexAll(src) {
+		if end := tok.End(); end != tok.Position+tok.Len {
+			t.Errorf("%v: expected End %d, got %d", tok, tok.Position+tok.Len, end)
+		} else if tok.Value != src[tok.Position:end] {
+			t.Errorf("%v: span ending at %d does not match source %q", tok, end, src[tok.Position:end])
+		}
+	}
+}
+
+func Test_SectionDelimiters(t *testing.T) {
+	const src = "<server>\nhost = a\n<<tls>>\ncert = b\n[not a section] = c\n"
+
+	lex := modconfigobj.NewLexer(strings.NewReader(src))
+	lex.SectionOpen = '<'
+	lex.SectionClose = '>'
+
+	expected := []modconfigobj.Token{
+		{TokenType: modconfigobj.ItemSection, Value: "<server>", Depth: 1, Name: "server"},
+		{TokenType: modconfigobj.ItemKey, Value: "host "},
+		{TokenType: modconfigobj.ItemValue, Value: "a"},
+		{TokenType: modconfigobj.ItemSection, Value: "<<tls>>", Depth: 2, Name: "tls"},
+		{TokenType: modconfigobj.ItemKey, Value: "cert "},
+		{TokenType: modconfigobj.ItemValue, Value: "b"},
+		{TokenType: modconfigobj.ItemKey, Value: "[not a section] "},
+		{TokenType: modconfigobj.ItemValue, Value: "c"},
+		{TokenType: modconfigobj.ItemEOF},
+	}
+	for _, e := range expected {
+		tok := lex.NextItem()
+		if tok.TokenType != e.TokenType || tok.Value != e.Value || tok.Depth != e.Depth || tok.Name != e.Name {
+			t.Fatalf("expected %+v, got %+v", e, tok)
+		}
+	}
+}
+
+func Test_SectionDelimitersMultibyte(t *testing.T) {
+	lex := modconfigobj.NewLexer(strings.NewReader("【【 sub 】】\n"))
+	lex.SectionOpen = '【'
+	lex.SectionClose = '】'
+
+	tok := lex.NextItem()
+	if tok.TokenType != modconfigobj.ItemSection || tok.Depth != 2 || tok.Name != "sub" {
+		t.Errorf("expected section sub at depth 2, got %+v", tok)
+	}
+}
+
+func Test_MaxTokenBytes(t *testing.T) {
+	lex := modconfigobj.NewLexer(strings.NewReader("key = short\nkey = " + strings.Repeat("x", 64) + "\nmore = value\n"))
+	lex.MaxTokenBytes = 16
+
+	for _, expected := range []string{"Keyword", "Value", "Keyword", "Error", "EOF"} {
+		tok := lex.NextItem()
+		if tok.TokenType.String() != expected {
+			t.Fatalf("expected %s, got %v", expected, tok)
+		}
+		if tok.IsError() && !strings.Contains(tok.Message, "token too large") {
+			t.Errorf("expected a token too large message, got %q", tok.Message)
+		}
+		if tok.Len > 64 {
+			t.Errorf("expected lexing to stop at the limit, got %d bytes", tok.Len)
+		}
+	}
+}
+
+func Test_CurrentSection(t *testing.T) {
+	const src = `root = 1
+[a]
+x = 2
+[[b]]
+y = 3
+[[[c]]]
+z = 4
+[[d]]
+w = 5
+[e]
+v = 6
+[[[skipped]]]
+u = 7
+`
+
+	expected := map[string][]string{
+		"root": nil,
+		"x":    {"a"},
+		"y":    {"a", "b"},
+		"z":    {"a", "b", "c"},
+		"w":    {"a", "d"},
+		"v":    {"e"},
+		"u":    {"e", "", "skipped"},
+	}
+
+	lex := modconfigobj.NewLexer(strings.NewReader(src))
+	var seen int
+	for tok := lex.NextItem(); !tok.IsEOF(); tok = lex.NextItem() {
+		if tok.IsSection() {
+			// the path of the section itself, until a key follows
+			if got := lex.CurrentSection(); len(got) != tok.Depth || got[len(got)-1] != tok.Name {
+				t.Errorf("%s: expected a path of depth %d ending in it, got %q", tok.Name, tok.Depth, got)
+			}
+		}
+		if !tok.IsKey() {
+			continue
+		}
+		seen++
+
+		key := strings.TrimSpace(tok.Value)
+		got := lex.CurrentSection()
+		if len(got) != len(expected[key]) || (len(got) > 0 && !reflect.DeepEqual(got, expected[key])) {
+			t.Errorf("%s: expected section %q, got %q", key, expected[key], got)
+		}
+	}
+
+	if seen != len(expected) {
+		t.Errorf("expected %d keys, saw %d", len(expected), seen)
+	}
+}
+
+func Test_IndentedAndSectionComments(t *testing.T) {
+	const src = "[s] # about s\n  # indented comment\nkey = value\n"
+
+	var got []string
+	for _, tok := range lexAll(src) {
+		got = append(got, tok.TokenType.String()+" "+tok.Value)
+	}
+
+	expected := []string{"Section [s]", "Comment # about s", "Comment # indented comment", "Keyword key ", "Value value", "EOF "}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
+
+func Test_InlineSectionComments(t *testing.T) {
+	const src = "[s]   # about s\n[[t]]\n  # standalone\nkey = value\n"
+
+	lex := modconfigobj.NewLexer(strings.NewReader(src))
+	lex.InlineSectionComments = true
+
+	expected := []modconfigobj.Token{
+		{TokenType: modconfigobj.ItemSection, Position: 0, Len: 3, Value: "[s]", Depth: 1, Name: "s", Comment: "# about s"},
+		{TokenType: modconfigobj.ItemSection, Position: 16, Len: 5, Value: "[[t]]", Depth: 2, Name: "t"},
+		{TokenType: modconfigobj.ItemComment, Position: 24, Len: 12, Value: "# standalone"},
+		{TokenType: modconfigobj.ItemKey, Position: 37, Len: 4, Value: "key "},
+	}
+	for _, e := range expected {
+		if tok := lex.NextItem(); tok != e {
+			t.Errorf("expected %+v, got %+v", e, tok)
+		}
+	}
+}
+
+var errBrokenReader = errors.New("broken reader")
+
+// brokenReader yields the runes of its input, then fails
+type brokenReader struct {
+	*strings.Reader
+}
+
+func (b brokenReader) ReadRune() (rune, int, error) {
+	if b.Len() == 0 {
+		return 0, 0, errBrokenReader
+	}
+	return b.Reader.ReadRune()
+}
+
+func Test_NextItemErr(t *testing.T) {
+	lex := modconfigobj.NewLexer(brokenReader{strings.NewReader("[section]\nkey = val")})
+
+	for _, expected := range []string{"Section", "Keyword"} {
+		tok, err := lex.NextItemErr()
+		if err != nil || tok.TokenType.String() != expected {
+			t.Fatalf("expected %s, got %v (%v)", expected, tok, err)
+		}
+	}
+
+	tok, err := lex.NextItemErr()
+	if !errors.Is(err, errBrokenReader) {
+		t.Errorf("expected the reader's error, got %v", err)
+	}
+	if !tok.IsError() || tok.Message != errBrokenReader.Error() {
+		t.Errorf("expected an error token for the read failure, got %+v", tok)
+	}
+
+	if tok, err := lex.NextItemErr(); !tok.IsEOF() || err != nil {
+		t.Errorf("expected EOF, got %v (%v)", tok, err)
+	}
+}
+
+func Test_NextItemReadErrorDoesNotPanic(t *testing.T) {
+	lex := modconfigobj.NewLexer(brokenReader{strings.NewReader("# comment")})
+
+	if tok := lex.NextItem(); !tok.IsError() {
+		t.Errorf("expected an error token, got %v", tok)
+	}
+	if tok := lex.NextItem(); !tok.IsEOF() {
+		t.Errorf("expected EOF, got %v", tok)
+	}
+}
+
+func Test_QuotedKeys(t *testing.T) {
+	cases := []struct {
+		src  string
+		want []string
+	}{
+		{`"a=b" = c` + "\n", []string{`Keyword "a=b" `, "Value c", "EOF "}},
+		{"'spaced key' = x\n", []string{"Keyword 'spaced key' ", "Value x", "EOF "}},
+		{`"tight"=x`, []string{`Keyword "tight"`, "Value x", "EOF "}},
+		{`"unterminated = x` + "\nkey = value\n", []string{`Error "unterminated = x` + "\n", "Keyword key ", "Value value", "EOF "}},
+		{`"a" b = x` + "\nkey = value\n", []string{`Error "a" b = x`, "Keyword key ", "Value value", "EOF "}},
+		{`ke"y = x` + "\n", []string{`Keyword ke"y `, "Value x", "EOF "}},
+	}
+
+	for _, c := range cases {
+		var got []string
+		for _, tok := range lexAll(c.src) {
+			got = append(got, tok.TokenType.String()+" "+tok.Value)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%q: expected %q, got %q", c.src, c.want, got)
+		}
+	}
+}
+
+func benchmarkLex(b *testing.B, src []byte) {
+	b.SetBytes(int64(len(src)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		lex := modconfigobj.NewLexer(bytes.NewReader(src))
+		for !lex.NextItem().IsEOF() {
+		}
+	}
+}
+
+func BenchmarkQuotedValues(b *testing.B) {
+	value := strings.Repeat("quoted text with 'inner' quotes ", 8)
+	benchmarkLex(b, []byte(strings.Repeat(`key = """`+value+`"""`+"\n", 500)))
+}
+
+func BenchmarkNestedSections(b *testing.B) {
+	benchmarkLex(b, []byte(strings.Repeat("[[[[[[ a rather long section name ]]]]]]\n", 500)))
+}
+
+var viewSrc = []byte(strings.Repeat("[section]\n# a comment\nkey = some value\nother = \"quoted value\"\n", 500))
+
+func BenchmarkNextItem(b *testing.B) {
+	benchmarkLex(b, viewSrc)
+}
+
+func BenchmarkNextView(b *testing.B) {
+	b.SetBytes(int64(len(viewSrc)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		lex := modconfigobj.NewLexer(bytes.NewReader(viewSrc))
+		for !lex.NextView().IsEOF() {
+		}
+	}
+}
+
+func Test_NextView(t *testing.T) {
+	src := "[section]\n# a comment\nkey = some value  \nother = \"quoted\"\nbad\n"
+
+	items := modconfigobj.NewLexer(strings.NewReader(src))
+	items.TrimValues = true
+	views := modconfigobj.NewLexer(strings.NewReader(src))
+	views.TrimValues = true
+	for {
+		want := items.NextItem()
+		if want.TokenType == modconfigobj.ItemKey {
+			// a peek in between must not disturb the borrowed text
+			views.Peek()
+		}
+		got := views.NextView()
+
+		if got.TokenType != want.TokenType || got.Position != want.Position || got.Len != want.Len {
+			t.Fatalf("expected %v, got %v", want, got.Token)
+		}
+		if string(got.Text()) != want.Value {
+			t.Errorf("expected text %q for %v, got %q", want.Value, want, got.Text())
+		}
+		if string(got.SeparatorText()) != want.Separator || got.Separator != "" {
+			t.Errorf("expected separator %q for %v, got %q", want.Separator, want, got.SeparatorText())
+		}
+		if want.IsEOF() {
+			break
+		}
+	}
+}
+
+func Test_QuoteAndBracketRuns(t *testing.T) {
+	cases := []struct {
+		src  string
+		want []string
+	}{
+		{`k = """a""b"c"""` + "\n", []string{"Keyword k ", `Value """a""b"c"""`, "EOF "}},
+		{`k = """a""""` + "\n", []string{"Keyword k ", `Value """a"""`, "Error \"\n", "EOF "}},
+		{`k = 'it''s'` + "\n", []string{"Keyword k ", "Value 'it'", "Error 's'", "EOF "}},
+		{`k = "unterminated`, []string{"Keyword k ", `Error "unterminated`, "EOF "}},
+		{"[[a]b]]\n", []string{"Section [[a]b]]", "EOF "}},
+		{"[[[a]]b]]]\n", []string{"Section [[[a]]b]]]", "EOF "}},
+		{"[[a]]]\n", []string{"Section [[a]]", "Error ]", "EOF "}},
+		{"[[a]\n", []string{"Error [[a]\n", "EOF "}},
+		{"[[a]", []string{"Error [[a]", "EOF "}},
+	}
+
+	for _, c := range cases {
+		var got []string
+		for _, tok := range lexAll(c.src) {
+			got = append(got, tok.TokenType.String()+" "+tok.Value)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%q: expected %q, got %q", c.src, c.want, got)
+		}
+	}
+}
+
+func Test_Stats(t *testing.T) {
+	const src = `# header comment
+root = 1
+[a]
+x = 1
+# about b
+[[b]]
+y = 2
+z = 3
+broken
+[c]
+`
+
+	lex := modconfigobj.NewLexer(strings.NewReader(src))
+	for !lex.NextItem().IsEOF() {
+	}
+
+	expected := modconfigobj.Stats{Sections: 3, Keys: 4, Comments: 2, Errors: 1}
+	if stats := lex.Stats(); stats != expected {
+		t.Errorf("expected %+v, got %+v", expected, stats)
+	}
+}
+
+func Test_DegenerateInput(t *testing.T) {
+	cases := []struct {
+		name string
+		src  string
+		want []modconfigobj.Token
+	}{
+		{"empty", "", []modconfigobj.Token{
+			{TokenType: modconfigobj.ItemEOF, Position: 0},
+		}},
+		{"whitespace", " \t \r\n  ", []modconfigobj.Token{
+			{TokenType: modconfigobj.ItemEOF, Position: 7},
+		}},
+		{"newline", "\n", []modconfigobj.Token{
+			{TokenType: modconfigobj.ItemEOF, Position: 1},
+		}},
+		{"comment without newline", "# comment", []modconfigobj.Token{
+			{TokenType: modconfigobj.ItemComment, Position: 0, Len: 9, Value: "# comment"},
+			{TokenType: modconfigobj.ItemEOF, Position: 9},
+		}},
+		{"lone hash", "#", []modconfigobj.Token{
+			{TokenType: modconfigobj.ItemComment, Position: 0, Len: 1, Value: "#"},
+			{TokenType: modconfigobj.ItemEOF, Position: 1},
+		}},
+	}
+
+	for _, c := range cases {
+		got := lexAll(c.src)
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: expected %+v, got %+v", c.name, c.want, got)
+		}
+	}
+}
+
+func Test_FlagKeys(t *testing.T) {
+	const src = "debug\nverbose # be chatty\nlevel = 3\nlast"
+
+	lex := modconfigobj.NewLexer(strings.NewReader(src))
+	lex.AllowFlagKeys = true
+
+	expected := []modconfigobj.Token{
+		{TokenType: modconfigobj.ItemKey, Position: 0, Len: 5, Value: "debug"},
+		{TokenType: modconfigobj.ItemValue, Position: 5},
+		{TokenType: modconfigobj.ItemKey, Position: 6, Len: 7, Value: "verbose"},
+		{TokenType: modconfigobj.ItemValue, Position: 13},
+		{TokenType: modconfigobj.ItemComment, Position: 14, Len: 11, Value: "# be chatty", Inline: true},
+		{TokenType: modconfigobj.ItemKey, Position: 26, Len: 6, Value: "level "},
+		{TokenType: modconfigobj.ItemValue, Position: 34, Len: 1, Value: "3", Separator: " = "},
+		{TokenType: modconfigobj.ItemKey, Position: 36, Len: 4, Value: "last"},
+		{TokenType: modconfigobj.ItemValue, Position: 40},
+		{TokenType: modconfigobj.ItemEOF, Position: 40},
+	}
+	for _, e := range expected {
+		if tok := lex.NextItem(); tok != e {
+			t.Errorf("expected %+v, got %+v", e, tok)
+		}
+	}
+}
+
+func Test_FlagKeysDisabled(t *testing.T) {
+	if tok := lexAll("debug\n")[0]; !tok.IsError() {
+		t.Errorf("expected a bare key to be an error by default, got %v", tok)
+	}
+}
+
+func Test_ASCIIWhitespaceOnly(t *testing.T) {
+	const src = "key = \u00a0padded\n"
+
+	for _, c := range []struct {
+		asciiOnly bool
+		value     string
+		separator string
+	}{
+		{false, "padded", " = \u00a0"},
+		{true, "\u00a0padded", " = "},
+	} {
+		lex := modconfigobj.NewLexer(strings.NewReader(src))
+		lex.ASCIIWhitespaceOnly = c.asciiOnly
+
+		lex.NextItem()
+		tok := lex.NextItem()
+		if tok.TokenType != modconfigobj.ItemValue || tok.Value != c.value || tok.Separator != c.separator {
+			t.Errorf("ASCIIWhitespaceOnly=%v: expected value %q with separator %q, got %+v", c.asciiOnly, c.value, c.separator, tok)
+		}
+	}
+}
+
+func Test_DoubleBackup(t *testing.T) {
+	lex := modconfigobj.NewLexer(strings.NewReader("key = value\n"))
+	modconfigobj.DoubleBackup(lex)
+
+	if tok := lex.NextItem(); !tok.IsError() {
+		t.Errorf("expected an error token, got %v", tok)
+	}
+	if tok := lex.NextItem(); !tok.IsEOF() {
+		t.Errorf("expected EOF after the error, got %v", tok)
+	}
+}
+
+func Test_ResetBeforeBackup(t *testing.T) {
+	const src = "key =\"x\"\n"
+
+	lex := modconfigobj.NewLexer(strings.NewReader(src))
+	modconfigobj.ResetBeforeBackup(lex)
+
+	var got []modconfigobj.Token
+	for tok := lex.NextItem(); !tok.IsEOF(); tok = lex.NextItem() {
+		got = append(got, tok)
+	}
+
+	expected := lexAll(src)
+	expected = expected[:len(expected)-1]
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	if len(got) != 2 || got[0].Value != "key " || got[1].Value != `"x"` {
+		t.Errorf("unexpected tokens %v", got)
+	}
+}
+
+func Test_TrimValues(t *testing.T) {
+	const src = "key =  spaced out \t\nempty =   \n"
+
+	for _, c := range []struct {
+		trim   bool
+		values []string
+	}{
+		{false, []string{"spaced out \t", ""}},
+		{true, []string{"spaced out", ""}},
+	} {
+		lex := modconfigobj.NewLexer(strings.NewReader(src))
+		lex.TrimValues = c.trim
+
+		var values []string
+		for tok := lex.NextItem(); !tok.IsEOF(); tok = lex.NextItem() {
+			if !tok.IsValue() {
+				continue
+			}
+			values = append(values, tok.Value)
+
+			if raw := src[tok.Position:tok.End()]; raw != "spaced out \t" && raw != "" {
+				t.Errorf("TrimValues=%v: expected the span to cover the raw value, got %q", c.trim, raw)
+			}
+		}
+
+		if !reflect.DeepEqual(values, c.values) {
+			t.Errorf("TrimValues=%v: expected values %q, got %q", c.trim, c.values, values)
+		}
+	}
+}
+
+func Test_RecoverSections(t *testing.T) {
+	const src = "[broken\nkey = value\n[[last"
+
+	for _, recovering := range []bool{false, true} {
+		lex := modconfigobj.NewLexer(strings.NewReader(src))
+		lex.RecoverSections = recovering
+
+		var numErrors int
+		var sections []string
+		for tok := lex.NextItem(); !tok.IsEOF(); tok = lex.NextItem() {
+			switch tok.TokenType {
+			case modconfigobj.ItemError:
+				numErrors++
+			case modconfigobj.ItemSection:
+				sections = append(sections, fmt.Sprintf("%d:%s", tok.Depth, tok.Name))
+				if tok.Value != src[tok.Position:tok.End()] {
+					t.Errorf("RecoverSections=%v: %v does not match its span", recovering, tok)
+				}
+			}
+		}
+
+		var expected []string
+		if recovering {
+			expected = []string{"1:broken", "2:last"}
+		}
+		if numErrors != 2 {
+			t.Errorf("RecoverSections=%v: expected 2 errors, got %d", recovering, numErrors)
+		}
+		if !reflect.DeepEqual(sections, expected) {
+			t.Errorf("RecoverSections=%v: expected sections %q, got %q", recovering, expected, sections)
+		}
+	}
+}
+
+// Test_Golden lexes every fixture in testdata and compares the token
+// stream to the fixture's .golden file. Run with -update to rewrite
+// the golden files after an intended change in behavior.
+func Test_Golden(t *testing.T) {
+	fixtures, err := filepath.Glob("testdata/*.ini")
+	if err != nil {
+		t.Fatal(err)
+	}
+	configobjs, err := filepath.Glob("testdata/*.configobj")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixtures = append(fixtures, configobjs...)
+	if len(fixtures) == 0 {
+		t.Fatal("no fixtures found in testdata")
+	}
+
+	for _, fixture := range fixtures {
+		t.Run(filepath.Base(fixture), func(t *testing.T) {
+			src, err := os.ReadFile(fixture)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got bytes.Buffer
+			for _, tok := range lexAll(string(src)) {
+				fmt.Fprintf(&got, "%s %d %d %q\n", tok.TokenType, tok.Position, tok.Len, tok.Value)
+			}
+
+			golden := strings.TrimSuffix(fixture, filepath.Ext(fixture)) + ".golden"
+			if *update {
+				if err := os.WriteFile(golden, got.Bytes(), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			expected, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got.Bytes(), expected) {
+				t.Errorf("token stream does not match %s:\n%s", golden, got.String())
+			}
+		})
+	}
+}
+
+func Test_EmitWhitespace(t *testing.T) {
+	const src = "  # comment\n\n[section]\n\tkey  =  value  \n" +
+		"list += more\nflag   \nlong = first\n   second\n" +
+		"quoted = \"q\"\ndoc = <<END\ntext\nEND\n  [[sub]]  \n\t\"k\" = 'v'"
+
+	lex := modconfigobj.NewLexerWithOptions(strings.NewReader(src), modconfigobj.WithTokenBuffer(2))
+	lex.EmitWhitespace = true
+	lex.AllowAppend = true
+	lex.AllowFlagKeys = true
+	lex.IndentContinuation = true
+	lex.Heredocs = true
+
+	var rebuilt strings.Builder
+	var whitespace int
+	for tok := lex.NextItem(); ; tok = lex.NextItem() {
+		if tok.IsError() {
+			t.Fatalf("unexpected error %v: %s", tok, tok.Message)
+		}
+		if tok.TokenType == modconfigobj.ItemWhitespace {
+			whitespace++
+		}
+		if tok.Value != src[tok.Position:tok.End()] {
+			t.Errorf("%v does not match its span %q", tok, src[tok.Position:tok.End()])
+		}
+		if tok.Position != int64(rebuilt.Len()) {
+			t.Errorf("%v does not follow the previous token ending at %d", tok, rebuilt.Len())
+		}
+
+		rebuilt.WriteString(tok.Value)
+		if tok.IsEOF() {
+			break
+		}
+	}
+
+	if rebuilt.String() != src {
+		t.Errorf("expected token values to rebuild the input, got %q", rebuilt.String())
+	}
+	if whitespace == 0 {
+		t.Error("expected whitespace tokens")
+	}
+
+	for _, tok := range lexAll(src) {
+		if tok.TokenType == modconfigobj.ItemWhitespace {
+			t.Errorf("expected no whitespace tokens by default, got %v", tok)
+		}
+	}
+}
+
+func Test_CommentsAtLineStartOnly(t *testing.T) {
+	const src = "# first column\n   # indented\n"
+
+	for _, c := range []struct {
+		strict bool
+		types  []string
+	}{
+		{false, []string{"Comment", "Comment", "EOF"}},
+		{true, []string{"Comment", "Error", "EOF"}},
+	} {
+		lex := modconfigobj.NewLexer(strings.NewReader(src))
+		lex.CommentsAtLineStartOnly = c.strict
+
+		var types []string
+		for tok := lex.NextItem(); ; tok = lex.NextItem() {
+			types = append(types, tok.TokenType.String())
+			if tok.IsEOF() {
+				break
+			}
+		}
+
+		if !reflect.DeepEqual(types, c.types) {
+			t.Errorf("CommentsAtLineStartOnly=%v: expected %v, got %v", c.strict, c.types, types)
+		}
+	}
+}
+
+func Test_EmptyQuotedValues(t *testing.T) {
+	for _, c := range []struct {
+		src   string
+		value string
+	}{
+		{"x = \"\"\n", `""`},
+		{"y = ''\n", `''`},
+		{"x = \"\"", `""`},
+		{"y = ''  \n", `''`},
+	} {
+		tokens := lexAll(c.src)
+		if len(tokens) != 3 || !tokens[1].IsValue() || tokens[1].Value != c.value {
+			t.Errorf("%q: expected the empty value %s, got %v", c.src, c.value, tokens)
+		}
+	}
+
+	tokens := lexAll("z = \"\"extra\n")
+	if len(tokens) < 2 || !tokens[1].IsError() || tokens[1].Message != "mismatched quotes" {
+		t.Errorf("expected a mismatched quotes error, got %v", tokens)
+	}
+}
+
+func Test_Consumed(t *testing.T) {
+	const src = "[section]\nkey = value\nüber = ✓\n"
+
+	lex := modconfigobj.NewLexer(strings.NewReader(src))
+	if n := lex.Consumed(); n != 0 {
+		t.Errorf("expected nothing consumed before lexing, got %d", n)
+	}
+
+	for tok := lex.NextItem(); !tok.IsEOF(); tok = lex.NextItem() {
+		if n := lex.Consumed(); n < tok.End() {
+			t.Errorf("%v: expected at least %d bytes consumed, got %d", tok, tok.End(), n)
+		}
+	}
+
+	if n := lex.Consumed(); n != int64(len(src)) {
+		t.Errorf("expected %d bytes consumed at EOF, got %d", len(src), n)
+	}
+}
+
+func Test_InlineValueComments(t *testing.T) {
+	const src = "# standalone\nkey = value  # trailing\nempty = # nothing\nurl = a#b\n  # indented\n[s] # header\n"
+
+	for _, split := range []bool{false, true} {
+		lex := modconfigobj.NewLexer(strings.NewReader(src))
+		lex.InlineValueComments = split
+
+		var values []string
+		var comments []string
+		for tok := lex.NextItem(); !tok.IsEOF(); tok = lex.NextItem() {
+			switch tok.TokenType {
+			case modconfigobj.ItemValue:
+				values = append(values, tok.Value)
+			case modconfigobj.ItemComment:
+				comments = append(comments, fmt.Sprintf("%s %v", tok.Value, tok.Inline))
+			}
+			if tok.Value != src[tok.Position:tok.End()] {
+				t.Errorf("InlineValueComments=%v: %v does not match its span", split, tok)
+			}
+		}
+
+		expectedValues := []string{"value  # trailing", "# nothing", "a#b"}
+		expectedComments := []string{"# standalone false", "# indented false", "# header true"}
+		if split {
+			expectedValues = []string{"value", "", "a#b"}
+			expectedComments = []string{"# standalone false", "# trailing true", "# nothing true", "# indented false", "# header true"}
+		}
+		if !reflect.DeepEqual(values, expectedValues) {
+			t.Errorf("InlineValueComments=%v: expected values %q, got %q", split, expectedValues, values)
+		}
+		if !reflect.DeepEqual(comments, expectedComments) {
+			t.Errorf("InlineValueComments=%v: expected comments %q, got %q", split, expectedComments, comments)
+		}
+	}
+}
+
+func Test_ErrorContext(t *testing.T) {
+	tokens := lexAll("[s]\nkey = \"\"x\nfine = ok\n")
+
+	var tok modconfigobj.Token
+	for _, tok = range tokens {
+		if tok.IsError() {
+			break
+		}
+	}
+
+	if tok.Context != `key = ""x` || tok.Column != 6 {
+		t.Errorf("expected context %q at column 6, got %q at column %d", `key = ""x`, tok.Context, tok.Column)
+	}
+	if s := tok.String(); !strings.HasSuffix(s, "\n\tkey = \"\"x\n\t      ^") {
+		t.Errorf("expected a caret under the error, got %q", s)
+	}
+
+	long := strings.Repeat("k", 300) + "\n"
+	if tok := lexAll(long)[0]; !tok.IsError() || tok.Context != long[:256] {
+		t.Errorf("expected the context of an overlong line to be cut short, got %q", tok.Context)
+	}
+}
+
+func Test_IndentBasedNesting(t *testing.T) {
+	const src = "[a]\nx = 1\n  [b]\n  y = 2\n    [c]\n[d]\n  [[e]]\n"
+
+	lex := modconfigobj.NewLexer(strings.NewReader(src))
+	lex.IndentBasedNesting = true
+
+	var sections []string
+	for tok := lex.NextItem(); !tok.IsEOF(); tok = lex.NextItem() {
+		if tok.IsError() {
+			t.Fatalf("unexpected error %v", tok)
+		}
+		if tok.IsSection() {
+			sections = append(sections, fmt.Sprintf("%d:%s", tok.Depth, tok.Name))
+		}
+	}
+
+	expected := []string{"1:a", "2:b", "3:c", "1:d", "2:e"}
+	if !reflect.DeepEqual(sections, expected) {
+		t.Errorf("expected %q, got %q", expected, sections)
+	}
+}
+
+func Test_IndentBasedNestingInconsistent(t *testing.T) {
+	for _, src := range []string{
+		"[a]\n  [b]\n   [c]\n",
+		"[a]\n\t[b]\n  [c]\n",
+		"[a]\n    [b]\n  [c]\n",
+		"  [a]\n",
+	} {
+		lex := modconfigobj.NewLexer(strings.NewReader(src))
+		lex.IndentBasedNesting = true
+
+		var errs int
+		for tok := lex.NextItem(); !tok.IsEOF(); tok = lex.NextItem() {
+			if tok.IsError() {
+				errs++
+			}
+		}
+		if errs != 1 {
+			t.Errorf("%q: expected 1 error, got %d", src, errs)
+		}
+	}
+}
+
+func Test_CommentEscapes(t *testing.T) {
+	const src = "color = \\#ff0000\nquoted = \"#ff0000\"\nnote = a \\#b # c\npath = C:\\dir\n"
+
+	lex := modconfigobj.NewLexer(strings.NewReader(src))
+	lex.CommentEscapes = true
+	lex.InlineValueComments = true
+
+	var got []string
+	for tok := lex.NextItem(); !tok.IsEOF(); tok = lex.NextItem() {
+		if tok.IsValue() || tok.IsComment() {
+			got = append(got, fmt.Sprintf("%s %q %q", tok.TokenType, tok.Value, src[tok.Position:tok.End()]))
+		}
+	}
+
+	expected := []string{
+		`Value "#ff0000" "\\#ff0000"`,
+		`Value "\"#ff0000\"" "\"#ff0000\""`,
+		`Value "a #b" "a \\#b"`,
+		`Comment "# c" "# c"`,
+		`Value "C:\\dir" "C:\\dir"`,
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
+
+func Test_LeadingEqualsRecovery(t *testing.T) {
+	tokens := lexAll("=bad\ngood = value\n")
+
+	if len(tokens) != 4 {
+		t.Fatalf("expected an error, a key, a value and EOF, got %v", tokens)
+	}
+	if !tokens[0].IsError() || tokens[0].Value != "=bad" || tokens[0].Message != "missing key before '='" {
+		t.Errorf("expected the whole line in a single error, got %v", tokens[0])
+	}
+	if !tokens[1].IsKey() || tokens[1].Value != "good " || !tokens[2].IsValue() || tokens[2].Value != "value" {
+		t.Errorf("expected the following pair to lex cleanly, got %v", tokens[1:])
+	}
+}
+
+func Test_Separator(t *testing.T) {
+	const src = "key => value\na=b => c\n'q' => quoted\nx = y\nbare =>\n"
+
+	lex := modconfigobj.NewLexer(strings.NewReader(src))
+	lex.Separator = "=>"
+
+	var got []string
+	for tok := lex.NextItem(); !tok.IsEOF(); tok = lex.NextItem() {
+		switch tok.TokenType {
+		case modconfigobj.ItemKey, modconfigobj.ItemError:
+			got = append(got, fmt.Sprintf("%s %q", tok.TokenType, tok.Value))
+		case modconfigobj.ItemValue:
+			got = append(got, fmt.Sprintf("%s %q %q", tok.TokenType, tok.Value, tok.Separator))
+		}
+	}
+
+	expected := []string{
+		`Keyword "key "`, `Value "value" " => "`,
+		`Keyword "a=b "`, `Value "c" " => "`,
+		`Keyword "'q' "`, `Value "quoted" " => "`,
+		`Error "x = y\n"`,
+		`Keyword "bare "`, `Value "" " =>"`,
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
+
+func Test_SeparatorOverlap(t *testing.T) {
+	cases := []struct {
+		separator string
+		src       string
+		expected  []string
+	}{
+		{"::=", "a :::= b\n", []string{`Keyword "a :"`, `Value "b"`}},
+		{"::=", "a :: = b\n", []string{`Error "a :: = b\n"`}},
+		{"aab", "xaaab = 1\n", []string{`Keyword "xa"`, `Value "= 1"`}},
+		{"", "a = b\n", []string{`Keyword "a "`, `Value "b"`}},
+	}
+
+	for _, c := range cases {
+		lex := modconfigobj.NewLexer(strings.NewReader(c.src))
+		lex.Separator = c.separator
+
+		var got []string
+		for tok := lex.NextItem(); !tok.IsEOF(); tok = lex.NextItem() {
+			got = append(got, fmt.Sprintf("%s %q", tok.TokenType, tok.Value))
+		}
+
+		if !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("%q with separator %q: expected %q, got %q", c.src, c.separator, c.expected, got)
+		}
+	}
+}
+
+func Test_TabsInValues(t *testing.T) {
+	const src = "key =\tvalue\twith\ttabs\t\n"
+
+	for _, trim := range []bool{false, true} {
+		lex := modconfigobj.NewLexer(strings.NewReader(src))
+		lex.TrimValues = trim
+
+		lex.NextItem()
+		tok := lex.NextItem()
+
+		expected := "value\twith\ttabs\t"
+		if trim {
+			expected = "value\twith\ttabs"
+		}
+		if tok.Value != expected || tok.Separator != " =\t" {
+			t.Errorf("TrimValues=%v: expected %q after %q, got %q after %q", trim, expected, " =\t", tok.Value, tok.Separator)
+		}
+		if tok.Position != 6 || tok.Len != 16 {
+			t.Errorf("TrimValues=%v: expected the span 6+16 to count every tab, got %d+%d", trim, tok.Position, tok.Len)
+		}
+	}
+}
+
+func Test_RegisterPrefix(t *testing.T) {
+	const src = "@include other.ini\nkey = value\n  @end"
+
+	lex := modconfigobj.NewLexer(strings.NewReader(src))
+	lex.RegisterPrefix('@', func(l *modconfigobj.Lexer) modconfigobj.Token {
+		// the directive runs to the end of the line, and is named by its
+		// first word
+		var line strings.Builder
+		for {
+			r, _, err := l.ReadRune()
+			if err != nil {
+				break
+			}
+			if r == '\n' {
+				l.UnreadRune()
+				break
+			}
+			line.WriteRune(r)
+		}
+
+		return modconfigobj.Token{TokenType: modconfigobj.ItemCustom, Name: strings.Fields(line.String())[0]}
+	})
+
+	var got []string
+	for tok := lex.NextItem(); ; tok = lex.NextItem() {
+		got = append(got, fmt.Sprintf("%s %d %q %q", tok.TokenType, tok.Position, tok.Value, tok.Name))
+		if tok.IsEOF() {
+			break
+		}
+	}
+
+	expected := []string{
+		`Custom 0 "@include other.ini" "include"`,
+		`Keyword 19 "key " ""`,
+		`Value 25 "value" ""`,
+		`Custom 33 "@end" "end"`,
+		`EOF 37 "" ""`,
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
+
+func Test_RelexFrom(t *testing.T) {
+	const src = "[first]\na = 1\n\n[second]\nb = 2\n  [[third]]\n  c = 3\n"
+	offset := int64(strings.Index(src, "[second]"))
+
+	lex := modconfigobj.NewLexer(strings.NewReader(src))
+	lex.Peek()
+	lex.NextItem()
+	lex.NextItem()
+
+	if err := lex.RelexFrom(offset); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []modconfigobj.Token
+	for tok := lex.NextItem(); ; tok = lex.NextItem() {
+		got = append(got, tok)
+		if tok.IsEOF() {
+			break
+		}
+	}
+
+	expected := lexAll(src[offset:])
+	for i := range expected {
+		expected[i].Position += offset
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+func Test_RelexFromUnseekable(t *testing.T) {
+	lex := modconfigobj.NewLexerFromReader(strings.NewReader("key = value\n"))
+	if err := lex.RelexFrom(0); err == nil {
+		t.Error("expected an error relexing an unseekable input")
+	}
+}
+
+func Test_LoneQuoteValues(t *testing.T) {
+	for _, src := range []string{
+		`x = "`, `x = '`, `x = """`, `x = '''`,
+		"x = \"\n", "x = '\n", "x = \"\"\"\n", "x = '''\n",
+	} {
+		tokens := lexAll(src)
+
+		var types []string
+		for _, tok := range tokens {
+			types = append(types, tok.TokenType.String())
+		}
+		expected := []string{"Keyword", "Error", "EOF"}
+		if !reflect.DeepEqual(types, expected) {
+			t.Errorf("%q: expected %v, got %v", src, expected, tokens)
+		} else if tokens[1].Message != "unterminated quoted value" {
+			t.Errorf("%q: expected an unterminated quoted value, got %q", src, tokens[1].Message)
+		}
+	}
+}
+
+func Test_NextItemPastEOF(t *testing.T) {
+	for _, src := range []string{"key = value\n", "[broken", ""} {
+		lex := modconfigobj.NewLexer(strings.NewReader(src))
+
+		var eof modconfigobj.Token
+		for eof = lex.NextItem(); !eof.IsEOF(); eof = lex.NextItem() {
+		}
+
+		for i := 0; i < 3; i++ {
+			if tok := lex.NextItem(); tok != eof {
+				t.Errorf("%q: expected %v again past EOF, got %v", src, eof, tok)
+			}
+		}
+	}
+}
+
+func Test_OnSection(t *testing.T) {
+	const src = "[a]\n[[b]]\n[c]\nkey = value\n"
+
+	lex := modconfigobj.NewLexer(strings.NewReader(src))
+	lex.OnSection = func(depth int, name string) error {
+		if depth > 1 {
+			return fmt.Errorf("section %s is nested", name)
+		}
+		return nil
+	}
+
+	var got []string
+	for tok := lex.NextItem(); !tok.IsEOF(); tok = lex.NextItem() {
+		switch tok.TokenType {
+		case modconfigobj.ItemSection:
+			got = append(got, "section "+tok.Name)
+		case modconfigobj.ItemError:
+			got = append(got, fmt.Sprintf("error %q %s", src[tok.Position:tok.End()], tok.Message))
+		}
+	}
+
+	expected := []string{"section a", `error "[[b]]" section b is nested`, "section c"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
+
+func Test_SectionTrailingText(t *testing.T) {
+	cases := []struct {
+		src  string
+		want []string
+	}{
+		{"[s] junk\nk = v\n", []string{"Section [s]", "Error junk", "Keyword k ", "Value v", "EOF "}},
+		{"[s]  # comment\nk = v\n", []string{"Section [s]", "Comment # comment", "Keyword k ", "Value v", "EOF "}},
+		{"[s]\t\n", []string{"Section [s]", "EOF "}},
+		{"[s] [t]", []string{"Section [s]", "Error [t]", "EOF "}},
+	}
+
+	for _, c := range cases {
+		lex := modconfigobj.NewLexer(strings.NewReader(c.src))
+		var got []string
+		for {
+			tok := lex.NextItem()
+			got = append(got, tok.TokenType.String()+" "+tok.Value)
+			if tok.TokenType == modconfigobj.ItemError && tok.Message != "unexpected text after section header" {
+				t.Errorf("%q: unexpected error message %q", c.src, tok.Message)
+			}
+			if tok.IsEOF() {
+				break
+			}
+		}
+
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%q: expected %q, got %q", c.src, c.want, got)
+		}
+	}
+}
+
+func Test_Filename(t *testing.T) {
+	cases := []struct {
+		src      string
+		expected string
+	}{
+		{"[s]\nkey = \"\"x\n", "app.ini:2:7: "},
+		{"a = 1\nkey\n", "app.ini:2:1: missing '=' after key"},
+		{"a = 1\n" + strings.Repeat(" ", 275) + "=x\n", "app.ini:2:276: missing key before '='"},
+	}
+
+	for _, c := range cases {
+		lex := modconfigobj.NewLexerWithOptions(strings.NewReader(c.src), modconfigobj.WithFilename("app.ini"))
+
+		tok := lex.NextItem()
+		for !tok.IsError() && !tok.IsEOF() {
+			tok = lex.NextItem()
+		}
+
+		if s := tok.String(); !strings.HasPrefix(s, c.expected) {
+			t.Errorf("%q: expected an error beginning %q, got %q", c.src, c.expected, s)
+		}
+	}
+}
+
+func Test_MultilineQuotes(t *testing.T) {
+	const src = "a = \"one\ntwo\"\nb = \"\"\"three\nfour\"\"\"\n"
+
+	cases := []struct {
+		multiline bool
+		expected  []string
+	}{
+		{false, []string{"Keyword a ", "Error \"one", "Error two\"\n", "Keyword b ", "Value \"\"\"three\nfour\"\"\"", "EOF "}},
+		{true, []string{"Keyword a ", "Value \"one\ntwo\"", "Keyword b ", "Value \"\"\"three\nfour\"\"\"", "EOF "}},
+	}
+
+	for _, c := range cases {
+		lex := modconfigobj.NewLexer(strings.NewReader(src))
+		lex.MultilineQuotes = c.multiline
+
+		var got []string
+		for tok := lex.NextItem(); ; tok = lex.NextItem() {
+			got = append(got, tok.TokenType.String()+" "+tok.Value)
+			if tok.IsEOF() {
+				break
+			}
+		}
+
+		if !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("MultilineQuotes %v: expected %q, got %q", c.multiline, c.expected, got)
+		}
+	}
+}
+
+func Test_SlashComments(t *testing.T) {
+	cases := []struct {
+		src      string
+		expected []string
+	}{
+		{"// comment\n", []string{"Comment // comment", "EOF "}},
+		{"  // indented\n[s] // trailing\n", []string{"Comment // indented", "Section [s]", "Comment // trailing", "EOF "}},
+		{"/\n", []string{"Error /\n", "EOF "}},
+		{"/ = 1\n", []string{"Keyword / ", "Value 1", "EOF "}},
+		{"path = a/b//c\n", []string{"Keyword path ", "Value a/b//c", "EOF "}},
+		{"//", []string{"Comment //", "EOF "}},
+	}
+
+	for _, c := range cases {
+		lex := modconfigobj.NewLexer(strings.NewReader(c.src))
+		lex.SlashComments = true
+
+		var got []string
+		for tok := lex.NextItem(); ; tok = lex.NextItem() {
+			got = append(got, tok.TokenType.String()+" "+tok.Value)
+			if tok.IsEOF() {
+				break
+			}
+		}
+
+		if !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("%q: expected %q, got %q", c.src, c.expected, got)
+		}
+	}
+
+	if tok := lexAll("// comment\n")[0]; tok.IsComment() {
+		t.Errorf("expected \"//\" not to begin a comment without SlashComments, got %v", tok)
+	}
+}
+
+func Test_QuotedListValues(t *testing.T) {
+	cases := []struct {
+		src      string
+		expected []string
+	}{
+		{"k = \"a=1\", \"b,c\"\n", []string{"Keyword k ", `Value "a=1", "b,c"`, "EOF "}},
+		{"k = \"\" , x", []string{"Keyword k ", `Value "" , x`, "EOF "}},
+		{"k = \"a\"  # c\n", []string{"Keyword k ", `Value "a"`, "Comment # c", "EOF "}},
+		{"k = \"a\", b  # c\n", []string{"Keyword k ", `Value "a", b`, "Comment # c", "EOF "}},
+		{"k = \"a\", b\\# c\n", []string{"Keyword k ", `Value "a", b# c`, "EOF "}},
+	}
+
+	for _, c := range cases {
+		lex := modconfigobj.NewLexer(strings.NewReader(c.src))
+		lex.InlineValueComments = true
+		lex.CommentEscapes = true
+
+		var got []string
+		for tok := lex.NextItem(); ; tok = lex.NextItem() {
+			got = append(got, tok.TokenType.String()+" "+tok.Value)
+			if tok.IsEOF() {
+				break
+			}
+		}
+
+		if !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("%q: expected %q, got %q", c.src, c.expected, got)
+		}
+	}
+}
+
+func Test_NextValid(t *testing.T) {
+	const src = "a = 1\nbroken\n[s]\n= orphan\nb = 2\n[unterminated\n"
+
+	lex := modconfigobj.NewLexer(strings.NewReader(src))
+
+	var got []string
+	for tok := lex.NextValid(); !tok.IsEOF(); tok = lex.NextValid() {
+		got = append(got, tok.TokenType.String()+" "+tok.Value)
+	}
+
+	expected := []string{"Keyword a ", "Value 1", "Section [s]", "Keyword b ", "Value 2"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+
+	var errs modconfigobj.LexErrors
+	if err := lex.Err(); !errors.As(err, &errs) || len(errs) != 3 {
+		t.Fatalf("expected 3 errors, got %v", err)
+	}
+	if errs[0].Position != 6 || errs[1].Position != 17 || errs[2].Position != 32 {
+		t.Errorf("unexpected error positions in %v", errs)
+	}
+
+	if err := modconfigobj.NewLexer(strings.NewReader("a = 1\n")).Err(); err != nil {
+		t.Errorf("expected no errors, got %v", err)
+	}
+}
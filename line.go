@@ -0,0 +1,29 @@
+package modconfigobj
+
+import "bytes"
+
+// Line returns the text of the 1-based line lineNo of src, without its
+// line ending, such as the line named by the Line of an error token.
+// It reports false if src has no such line.
+func Line(src []byte, lineNo int) (string, bool) {
+	if lineNo < 1 {
+		return "", false
+	}
+
+	for n := 1; n < lineNo; n++ {
+		i := bytes.IndexByte(src, '\n')
+		if i < 0 {
+			return "", false
+		}
+		src = src[i+1:]
+	}
+
+	if i := bytes.IndexByte(src, '\n'); i >= 0 {
+		src = src[:i]
+	} else if len(src) == 0 {
+		// the input ends with a newline, so there is no further line
+		return "", false
+	}
+
+	return string(bytes.TrimSuffix(src, []byte("\r"))), true
+}
@@ -0,0 +1,51 @@
+package modconfigobj_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/christian-blades-cb/modconfigobj"
+)
+
+func Test_Line(t *testing.T) {
+	const src = "[s]\r\nkey = value\n\nlast"
+
+	cases := []struct {
+		lineNo   int
+		expected string
+		ok       bool
+	}{
+		{0, "", false},
+		{1, "[s]", true},
+		{2, "key = value", true},
+		{3, "", true},
+		{4, "last", true},
+		{5, "", false},
+	}
+
+	for _, c := range cases {
+		line, ok := modconfigobj.Line([]byte(src), c.lineNo)
+		if line != c.expected || ok != c.ok {
+			t.Errorf("line %d: expected %q, %v, got %q, %v", c.lineNo, c.expected, c.ok, line, ok)
+		}
+	}
+
+	if _, ok := modconfigobj.Line([]byte("a\n"), 2); ok {
+		t.Error("expected no line following the final newline")
+	}
+}
+
+func Test_LineOfError(t *testing.T) {
+	src := []byte("[s]\nkey = 1\nbroken\n")
+
+	lex := modconfigobj.NewLexer(bytes.NewReader(src))
+	tok := lex.NextItem()
+	for !tok.IsError() && !tok.IsEOF() {
+		tok = lex.NextItem()
+	}
+
+	line, ok := modconfigobj.Line(src, tok.Line)
+	if !ok || line != "broken" {
+		t.Errorf("expected the line of %v to be %q, got %q", tok, "broken", line)
+	}
+}
@@ -0,0 +1,172 @@
+package modconfigobj
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Marshal returns the configobj text for the struct (or pointer to
+// struct) v, which Unmarshal reads back into an equal struct.
+//
+// Fields are named and skipped according to their configobj tags as
+// for Unmarshal. A tag option of omitempty, as in
+// `configobj:"name,omitempty"`, leaves out a field holding its zero
+// value. Keys are written ahead of sections, and a struct field is
+// written as a section holding its own keys and subsections. Slices
+// are written as comma separated lists, with an empty value for an
+// empty slice, which Unmarshal reads back as nil.
+//
+// Values are quoted only when they would otherwise not be read back
+// as-is, such as a value with surrounding whitespace or an opening
+// quote, or a list element containing a comma. A section name that
+// EncodeSectionName can't write so that it reads back as-is, such as
+// one with surrounding whitespace or a newline, is an error.
+func Marshal(v interface{}) ([]byte, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Ptr && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("Marshal expects a struct or a pointer to one, got %T", v)
+	}
+
+	var buf bytes.Buffer
+	if err := marshalSection(&buf, rv, nil); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// marshalSection writes the keys of the struct s followed by its
+// subsections. path holds the names of s and its enclosing sections.
+func marshalSection(buf *bytes.Buffer, s reflect.Value, path []string) error {
+	type section struct {
+		name  string
+		value reflect.Value
+	}
+	var sections []section
+
+	st := s.Type()
+	for i := 0; i < st.NumField(); i++ {
+		f := st.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+
+		name, opts := fieldTag(f)
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+
+		field := s.Field(i)
+		if field.IsZero() && strings.Contains(","+opts+",", ",omitempty,") {
+			continue
+		}
+
+		if field.Kind() == reflect.Ptr && field.Type().Elem().Kind() == reflect.Struct {
+			if field.IsNil() {
+				continue
+			}
+			field = field.Elem()
+		}
+		if field.Kind() == reflect.Struct {
+			sections = append(sections, section{name, field})
+			continue
+		}
+
+		value, err := formatField(field)
+		if err != nil {
+			return fmt.Errorf("cannot marshal %s: %w", strings.Join(append(path, name), "."), err)
+		}
+		fmt.Fprintf(buf, "%s = %s\n", name, value)
+	}
+
+	depth := len(path) + 1
+	for _, sec := range sections {
+		if buf.Len() > 0 {
+			buf.WriteByte('\n')
+		}
+		if strings.TrimSpace(sec.name) != sec.name || strings.Contains(sec.name, "\n") {
+			return fmt.Errorf("cannot marshal section %q: name would not read back as-is", strings.Join(append(path, sec.name), "."))
+		}
+		fmt.Fprintf(buf, "%s%s%s\n", strings.Repeat("[", depth), EncodeSectionName(sec.name), strings.Repeat("]", depth))
+
+		if err := marshalSection(buf, sec.value, append(path, sec.name)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// EncodeSectionName escapes the brackets in name so that it can be
+// written between the brackets of a section header. A lexer with
+// SectionEscapes and DecodeSectionEscapes set reads the header back
+// with name as its Name, unless name has surrounding whitespace, which
+// is always trimmed from section names, or a newline, which ends the
+// header early.
+func EncodeSectionName(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		if r == '[' || r == ']' {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+
+	if strings.HasSuffix(name, "\\") {
+		// keep the backslash from escaping the closing bracket
+		b.WriteByte(' ')
+	}
+
+	return b.String()
+}
+
+// formatField renders field as a value, quoting it if necessary
+func formatField(field reflect.Value) (string, error) {
+	if field.Kind() != reflect.Slice {
+		s, err := formatScalar(field)
+		if err != nil {
+			return "", err
+		}
+		return EncodeValue(s)
+	}
+
+	elems := make([]string, field.Len())
+	for i := range elems {
+		s, err := formatScalar(field.Index(i))
+		if err != nil {
+			return "", err
+		}
+		// a comma would split the element in two
+		if elems[i], err = quoteValue(s, strings.Contains(s, ",")); err != nil {
+			return "", err
+		}
+	}
+
+	return strings.Join(elems, ", "), nil
+}
+
+func formatScalar(field reflect.Value) (string, error) {
+	switch field.Kind() {
+	case reflect.String:
+		return field.String(), nil
+	case reflect.Bool:
+		return strconv.FormatBool(field.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(field.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(field.Uint(), 10), nil
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(field.Float(), 'g', -1, field.Type().Bits()), nil
+	default:
+		return "", fmt.Errorf("unsupported field type %s", field.Type())
+	}
+}
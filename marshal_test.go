@@ -0,0 +1,162 @@
+package modconfigobj_test
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/christian-blades-cb/modconfigobj"
+)
+
+func Test_Marshal(t *testing.T) {
+	type limits struct {
+		Max  int    `configobj:"max"`
+		Note string `configobj:"note,omitempty"`
+	}
+	type config struct {
+		Name   string  `configobj:"name"`
+		Empty  string  `configobj:"empty,omitempty"`
+		Ratio  float32 `configobj:"ratio"`
+		Limits limits  `configobj:"limits"`
+		Hidden string  `configobj:"-"`
+	}
+
+	out, err := modconfigobj.Marshal(config{
+		Name:   "example",
+		Ratio:  0.5,
+		Limits: limits{Max: 10},
+		Hidden: "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const expected = "name = example\nratio = 0.5\n\n[limits]\nmax = 10\n"
+	if string(out) != expected {
+		t.Errorf("expected %q, got %q", expected, out)
+	}
+}
+
+func Test_MarshalRoundTrip(t *testing.T) {
+	cfg := appConfig{
+		Name:    "  padded  ",
+		Workers: -1,
+		Server: serverConfig{
+			Host:    `"quoted"`,
+			Port:    443,
+			Load:    1e-3,
+			Motd:    "two\nlines",
+			Retries: []int{5, 10},
+			TLS: &tlsConfig{
+				Cert:    "it's",
+				Ciphers: []string{"ECDHE", " spaced ", "", "a=1", "b,c"},
+			},
+		},
+	}
+
+	out, err := modconfigobj.Marshal(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got appConfig
+	if err := modconfigobj.Unmarshal(bytes.NewReader(out), &got); err != nil {
+		t.Fatalf("%v in:\n%s", err, out)
+	}
+	if !reflect.DeepEqual(got, cfg) {
+		t.Errorf("expected %+v, got %+v from:\n%s", cfg, got, out)
+	}
+}
+
+func Test_MarshalEmptySlices(t *testing.T) {
+	type lists struct {
+		Ints    []int
+		Strings []string
+		Blank   []string
+	}
+	cfg := lists{Blank: []string{""}}
+
+	out, err := modconfigobj.Marshal(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got lists
+	if err := modconfigobj.Unmarshal(bytes.NewReader(out), &got); err != nil {
+		t.Fatalf("%v in:\n%s", err, out)
+	}
+	if !reflect.DeepEqual(got, cfg) {
+		t.Errorf("expected %#v, got %#v from:\n%s", cfg, got, out)
+	}
+}
+
+func Test_MarshalErrors(t *testing.T) {
+	for _, v := range []interface{}{
+		"not a struct",
+		(*appConfig)(nil),
+		struct{ Both string }{`'''"""`},
+		struct{ List []string }{[]string{`a,'''"""`}},
+		struct{ Map map[string]string }{map[string]string{}},
+		struct {
+			S struct{ K string } `configobj:" padded"`
+		}{},
+		struct {
+			S struct{ K string } "configobj:\"two\\nlines\""
+		}{},
+	} {
+		if out, err := modconfigobj.Marshal(v); err == nil {
+			t.Errorf("%#v: expected an error, got %q", v, out)
+		}
+	}
+}
+
+func Test_EncodeSectionName(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		encoded string
+	}{
+		{"plain", "plain"},
+		{"with spaces", "with spaces"},
+		{"weird]name", `weird\]name`},
+		{"[both]", `\[both\]`},
+		{`back\slash`, `back\slash`},
+		{`trailing\`, `trailing\ `},
+		{`escaped\[`, `escaped\\[`},
+	} {
+		encoded := modconfigobj.EncodeSectionName(c.name)
+		if encoded != c.encoded {
+			t.Errorf("%q: expected %q, got %q", c.name, c.encoded, encoded)
+		}
+
+		lex := modconfigobj.NewLexer(strings.NewReader("[[" + encoded + "]]\n"))
+		lex.SectionEscapes = true
+		lex.DecodeSectionEscapes = true
+		if tok := lex.NextItem(); !tok.IsSection() || tok.Name != c.name || tok.Depth != 2 {
+			t.Errorf("%q: expected to read back a depth 2 section, got %v named %q", c.name, tok, tok.Name)
+		}
+	}
+}
+
+func Test_MarshalSectionNames(t *testing.T) {
+	type inner struct {
+		Key string `configobj:"key"`
+	}
+	type config struct {
+		Odd inner `configobj:"odd]name"`
+	}
+
+	cfg := config{Odd: inner{Key: "value"}}
+	out, err := modconfigobj.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got config
+	if err := modconfigobj.Unmarshal(bytes.NewReader(out), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got != cfg {
+		t.Errorf("expected %+v, got %+v from:\n%s", cfg, got, out)
+	}
+}
@@ -0,0 +1,123 @@
+package modconfigobj
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Change sets the value of the key at Path, the names of its enclosing
+// sections followed by the key's name. Value is written as-is, so it
+// must be quoted by the caller if necessary.
+type Change struct {
+	Path  []string
+	Value string
+}
+
+// Patch applies changes to src, splicing each new value over the old
+// one and leaving every other byte untouched. A key defined more than
+// once has every definition changed. A key that isn't defined is
+// appended on a new line after the last value (or the header) of its
+// section, which must already exist, matching that line's indentation.
+// Keys outside of any section are inserted ahead of the first header.
+//
+// It is an error for two changes to set the same key to different
+// values.
+func Patch(src []byte, changes []Change) ([]byte, error) {
+	values := map[string]string{}
+	for _, c := range changes {
+		if len(c.Path) == 0 {
+			return nil, fmt.Errorf("change to %q has an empty path", c.Value)
+		}
+
+		k := patchKey(c.Path)
+		if v, ok := values[k]; ok && v != c.Value {
+			return nil, fmt.Errorf("conflicting changes to %s: %q and %q", strings.Join(c.Path, "."), v, c.Value)
+		}
+		values[k] = c.Value
+	}
+
+	found := map[string]bool{}
+	out, err := Transform(src, func(path []string, old string) string {
+		k := patchKey(path)
+		v, ok := values[k]
+		if !ok {
+			return old
+		}
+
+		found[k] = true
+		// unquoted values run to the end of the line, so keep any
+		// trailing whitespace that was part of the old value
+		return v + old[len(strings.TrimRightFunc(old, unicode.IsSpace)):]
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range changes {
+		k := patchKey(c.Path)
+		if found[k] {
+			continue
+		}
+
+		if out, err = appendKey(out, c.Path, c.Value); err != nil {
+			return nil, err
+		}
+		found[k] = true
+	}
+
+	return out, nil
+}
+
+// patchKey joins path so that names containing dots stay distinct
+func patchKey(path []string) string {
+	return strings.Join(path, "\x00")
+}
+
+// appendKey inserts "key = value" on a new line following the line of
+// the last value (or the header) of the section named by
+// path[:len(path)-1], matching its indentation. Keys outside of any section
+// are inserted ahead of the first section header.
+func appendKey(src []byte, path []string, value string) ([]byte, error) {
+	section := patchKey(path[:len(path)-1])
+	key := path[len(path)-1]
+
+	anchor := int64(-1)
+	lex := NewLexer(bytes.NewReader(src))
+	for t := lex.NextItem(); t.TokenType != ItemEOF; t = lex.NextItem() {
+		switch t.TokenType {
+		case ItemError:
+			return nil, fmt.Errorf("bad token at %d: %s", t.Position, t.Message)
+		case ItemSection, ItemValue:
+			if patchKey(lex.CurrentSection()) == section {
+				anchor = t.End()
+			}
+		}
+	}
+
+	if anchor < 0 {
+		if section != "" {
+			return nil, fmt.Errorf("section %s not found", strings.Join(path[:len(path)-1], "."))
+		}
+
+		return append([]byte(fmt.Sprintf("%s = %s\n", key, value)), src...), nil
+	}
+
+	lineStart := bytes.LastIndexByte(src[:anchor], '\n') + 1
+	line := src[lineStart:anchor]
+	indent := line[:len(line)-len(bytes.TrimLeft(line, " \t"))]
+
+	// insert after anything trailing the anchor, such as a comment
+	lineEnd := len(src)
+	if i := bytes.IndexByte(src[anchor:], '\n'); i >= 0 {
+		lineEnd = int(anchor) + i
+	}
+
+	out := make([]byte, 0, len(src)+len(key)+len(value)+len(indent)+4)
+	out = append(out, src[:lineEnd]...)
+	out = append(out, fmt.Sprintf("\n%s%s = %s", indent, key, value)...)
+	out = append(out, src[lineEnd:]...)
+
+	return out, nil
+}
@@ -0,0 +1,96 @@
+package modconfigobj_test
+
+import (
+	"testing"
+
+	"github.com/christian-blades-cb/modconfigobj"
+)
+
+func Test_Patch(t *testing.T) {
+	const src = `# settings
+name = old  
+[server]
+  host = localhost
+  port = 80
+[[tls]]
+  cert = a.pem
+`
+	const expected = `# settings
+name = new  
+[server]
+  host = localhost
+  port = 8080
+  timeout = 30
+[[tls]]
+  cert = a.pem
+`
+
+	out, err := modconfigobj.Patch([]byte(src), []modconfigobj.Change{
+		{Path: []string{"name"}, Value: "new"},
+		{Path: []string{"server", "port"}, Value: "8080"},
+		{Path: []string{"server", "timeout"}, Value: "30"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(out) != expected {
+		t.Errorf("expected %q, got %q", expected, out)
+	}
+}
+
+func Test_PatchAppendAfterComment(t *testing.T) {
+	cases := []struct {
+		src      string
+		expected string
+	}{
+		{"[s] # main\n", "[s] # main\nk = v\n"},
+		{"[s]\nport = \"80\"  # c\n", "[s]\nport = \"80\"  # c\nk = v\n"},
+		{"[s]\nport = \"80\"  # c", "[s]\nport = \"80\"  # c\nk = v"},
+	}
+
+	for _, c := range cases {
+		out, err := modconfigobj.Patch([]byte(c.src), []modconfigobj.Change{{Path: []string{"s", "k"}, Value: "v"}})
+		if err != nil {
+			t.Fatalf("%q: %v", c.src, err)
+		}
+		if string(out) != c.expected {
+			t.Errorf("%q: expected %q, got %q", c.src, c.expected, out)
+		}
+	}
+}
+
+func Test_PatchQuotedKey(t *testing.T) {
+	const src = "[db]\n\"user name\" = bob\nport = 5432\n"
+	const expected = "[db]\n\"user name\" = alice\nport = 5432\n"
+
+	out, err := modconfigobj.Patch([]byte(src), []modconfigobj.Change{{Path: []string{"db", "user name"}, Value: "alice"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != expected {
+		t.Errorf("expected %q, got %q", expected, out)
+	}
+}
+
+func Test_PatchErrors(t *testing.T) {
+	const src = "[server]\nport = 80\n"
+
+	cases := []struct {
+		name    string
+		changes []modconfigobj.Change
+	}{
+		{"conflict", []modconfigobj.Change{
+			{Path: []string{"server", "port"}, Value: "1"},
+			{Path: []string{"server", "port"}, Value: "2"},
+		}},
+		{"missing section", []modconfigobj.Change{{Path: []string{"client", "port"}, Value: "1"}}},
+		{"empty path", []modconfigobj.Change{{Value: "1"}}},
+	}
+
+	for _, c := range cases {
+		if out, err := modconfigobj.Patch([]byte(src), c.changes); err == nil {
+			t.Errorf("%s: expected an error, got %q", c.name, out)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package modconfigobj
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// RoundTrip lexes src and reassembles it from the emitted tokens,
+// copying each token's span (and the whitespace and separators
+// between tokens) verbatim from the original. For a valid file the
+// output is byte-identical to the input. An error is returned if the
+// lexer emits an error token, or if the tokens do not account for
+// every meaningful byte in src.
+func RoundTrip(src []byte) ([]byte, error) {
+	lex := NewLexer(bytes.NewReader(src))
+	out := make([]byte, 0, len(src))
+
+	var end int64
+	for {
+		t := lex.NextItem()
+		if t.TokenType == ItemError {
+			return nil, fmt.Errorf("bad token at %d: %q", t.Position, t.Value)
+		}
+
+		if t.Position < end || t.End() > int64(len(src)) {
+			return nil, fmt.Errorf("%v does not follow previous token ending at %d", t, end)
+		}
+
+		gap := src[end:t.Position]
+		if !isTokenSeparator(gap) {
+			return nil, fmt.Errorf("lexer dropped %q at %d", gap, end)
+		}
+
+		span := src[t.Position:t.End()]
+		if t.Value != string(span) {
+			return nil, fmt.Errorf("%v does not match source %q", t, span)
+		}
+
+		out = append(out, gap...)
+		out = append(out, span...)
+		end = t.End()
+
+		if t.TokenType == ItemEOF {
+			break
+		}
+	}
+
+	if end != int64(len(src)) {
+		return nil, fmt.Errorf("lexer stopped at %d of %d bytes", end, len(src))
+	}
+
+	return out, nil
+}
+
+// isTokenSeparator reports whether b is made up only of whitespace
+// and at most one key/value separator
+func isTokenSeparator(b []byte) bool {
+	b = bytes.TrimSpace(b)
+	return len(b) == 0 || (len(b) == 1 && b[0] == '=')
+}
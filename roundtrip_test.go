@@ -0,0 +1,36 @@
+package modconfigobj_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/christian-blades-cb/modconfigobj"
+)
+
+func Test_RoundTrip(t *testing.T) {
+	fixtures := []struct {
+		name string
+		src  string
+	}{
+		{"simple", SimpleFile},
+		{"empty", ""},
+		{"comments", "# leading comment\n[section]\n  # indented comment\nkey = value\n"},
+		{"nested", "[a]\nx = 1\n[[b]]\ny = 2\n[[[c]]]\nz = 3\n[d]\nw = 4\n"},
+		{"quoted", "[q]\nsingle = 'one'\ndouble = \"two\"\ntriple = \"\"\"three\"\"\"\n"},
+		{"spacing", "key=value\n  spaced   =   value  \n\n\n\tkey\t=\tvalue\n"},
+		{"no trailing newline", "[s]\nkey = value"},
+		{"crlf", "[s]\r\nkey = value\r\n"},
+		{"empty value", "key =\nother = value\n"},
+	}
+
+	for _, f := range fixtures {
+		out, err := modconfigobj.RoundTrip([]byte(f.src))
+		if err != nil {
+			t.Errorf("%s: %v", f.name, err)
+			continue
+		}
+		if !bytes.Equal(out, []byte(f.src)) {
+			t.Errorf("%s: expected %q, got %q", f.name, f.src, out)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package modconfigobj
+
+import "io"
+
+// Scanner provides a bufio.Scanner style interface over a Lexer.
+// Successive calls to Scan step through the tokens of the input,
+// stopping at the end of the input or at the first invalid token.
+//
+//	s := NewScanner(r)
+//	for s.Scan() {
+//		t := s.Token()
+//		...
+//	}
+//	if err := s.Err(); err != nil {
+//		...
+//	}
+type Scanner struct {
+	lex   *Lexer
+	token Token
+	err   error
+	done  bool
+}
+
+// NewScanner returns a Scanner reading from r
+func NewScanner(r io.Reader) *Scanner {
+	return &Scanner{lex: NewLexerFromReader(r)}
+}
+
+// Scan advances to the next token, which is then available from
+// Token. It returns false at the end of the input or when an invalid
+// token is encountered, in which case Err describes the problem.
+func (s *Scanner) Scan() bool {
+	if s.done {
+		return false
+	}
+
+	s.token = s.lex.NextItem()
+	switch s.token.TokenType {
+	case ItemEOF:
+		s.done = true
+		return false
+	case ItemError:
+		s.done = true
+		s.err = newLexError(s.token)
+		return false
+	}
+
+	return true
+}
+
+// Token returns the token produced by the most recent call to Scan
+func (s *Scanner) Token() Token {
+	return s.token
+}
+
+// Err returns the first invalid token encountered by the Scanner as a
+// LexError, or nil if the input was scanned cleanly
+func (s *Scanner) Err() error {
+	return s.err
+}
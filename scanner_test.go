@@ -0,0 +1,71 @@
+package modconfigobj_test
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/christian-blades-cb/modconfigobj"
+)
+
+func Test_ScannerLoop(t *testing.T) {
+	s := modconfigobj.NewScanner(strings.NewReader(SimpleFile))
+
+	var values []string
+	for s.Scan() {
+		values = append(values, s.Token().Value)
+	}
+
+	if err := s.Err(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []string{"[section]", "key ", "value"}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("expected %q, got %q", expected, values)
+	}
+
+	if s.Scan() {
+		t.Error("expected Scan to keep returning false after EOF")
+	}
+}
+
+func Test_ScannerError(t *testing.T) {
+	s := modconfigobj.NewScanner(strings.NewReader("[section]\nbroken\nkey = value\n"))
+
+	var count int
+	for s.Scan() {
+		count++
+	}
+
+	if count != 1 {
+		t.Errorf("expected to scan 1 token before the error, got %d", count)
+	}
+
+	var lexErr modconfigobj.LexError
+	if !errors.As(s.Err(), &lexErr) {
+		t.Fatalf("expected a LexError, got %v", s.Err())
+	}
+	if lexErr.Position != int64(len("[section]\n")) {
+		t.Errorf("expected the error at %d, got %d", len("[section]\n"), lexErr.Position)
+	}
+}
+
+func Test_ScannerReadError(t *testing.T) {
+	errBroken := errors.New("broken")
+	s := modconfigobj.NewScanner(io.MultiReader(strings.NewReader("key = "), iotest.ErrReader(errBroken)))
+	for s.Scan() {
+	}
+
+	if !errors.Is(s.Err(), errBroken) {
+		t.Errorf("expected the read error, got %v", s.Err())
+	}
+
+	var lexErr modconfigobj.LexError
+	if !errors.As(s.Err(), &lexErr) {
+		t.Fatalf("expected a LexError, got %v", s.Err())
+	}
+}
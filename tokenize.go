@@ -0,0 +1,29 @@
+package modconfigobj
+
+import "io"
+
+// Tokenize lexes r in a new goroutine, sending every token to the
+// returned channel, which is closed after the ItemEOF token. A read
+// error is sent as an ItemError followed by ItemEOF, so the channel is
+// closed then too.
+//
+// The goroutine only exits once ItemEOF has been received, so the
+// channel must be drained even if the caller loses interest early.
+func Tokenize(r io.Reader) <-chan Token {
+	ch := make(chan Token)
+
+	go func() {
+		defer close(ch)
+
+		lex := NewLexerFromReader(r)
+		for {
+			t := lex.NextItem()
+			ch <- t
+			if t.TokenType == ItemEOF {
+				return
+			}
+		}
+	}()
+
+	return ch
+}
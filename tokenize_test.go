@@ -0,0 +1,39 @@
+package modconfigobj_test
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/christian-blades-cb/modconfigobj"
+)
+
+func Test_Tokenize(t *testing.T) {
+	var got []string
+	for tok := range modconfigobj.Tokenize(strings.NewReader("[s]\nkey = value\n")) {
+		got = append(got, tok.TokenType.String()+" "+tok.Value)
+	}
+
+	expected := []string{"Section [s]", "Keyword key ", "Value value", "EOF "}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
+
+func Test_TokenizeReadError(t *testing.T) {
+	errBroken := errors.New("broken")
+	r := io.MultiReader(strings.NewReader("key = "), iotest.ErrReader(errBroken))
+
+	var got []string
+	for tok := range modconfigobj.Tokenize(r) {
+		got = append(got, tok.TokenType.String())
+	}
+
+	expected := []string{"Keyword", "Error", "EOF"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
@@ -0,0 +1,36 @@
+package modconfigobj
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// Transform lexes src and calls fn for every key/value pair, splicing
+// the returned value into the output in place of the original. The
+// key passed to fn is the section path followed by the key name
+// (without any quotes around it), and
+// value is the raw token value (including quotes, if any). Bytes that
+// are not part of a value are copied to the output untouched.
+func Transform(src []byte, fn func(key []string, value string) string) ([]byte, error) {
+	lex := NewLexer(bytes.NewReader(src))
+	out := make([]byte, 0, len(src))
+
+	var key []string
+	var last int64
+	for {
+		t := lex.NextItem()
+		switch t.TokenType {
+		case ItemError:
+			return nil, fmt.Errorf("bad token at %d: %s", t.Position, t.Message)
+		case ItemKey:
+			key = append(lex.CurrentSection(), unquote(strings.TrimSpace(t.Value)))
+		case ItemValue:
+			out = append(out, src[last:t.Position]...)
+			out = append(out, fn(key, t.Value)...)
+			last = t.End()
+		case ItemEOF:
+			return append(out, src[last:]...), nil
+		}
+	}
+}
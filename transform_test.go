@@ -0,0 +1,56 @@
+package modconfigobj_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/christian-blades-cb/modconfigobj"
+)
+
+func Test_TransformUppercase(t *testing.T) {
+	const src = `# top comment
+[section]
+key = value  # not a comment
+[[ sub ]]
+  # indented comment
+  other='quoted value'
+`
+	const expected = `# top comment
+[section]
+key = VALUE  # NOT A COMMENT
+[[ sub ]]
+  # indented comment
+  other='QUOTED VALUE'
+`
+
+	var paths [][]string
+	out, err := modconfigobj.Transform([]byte(src), func(key []string, value string) string {
+		paths = append(paths, key)
+		return strings.ToUpper(value)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(out) != expected {
+		t.Errorf("expected %q, got %q", expected, out)
+	}
+
+	expectedPaths := [][]string{
+		{"section", "key"},
+		{"section", "sub", "other"},
+	}
+	if !reflect.DeepEqual(paths, expectedPaths) {
+		t.Errorf("expected paths %v, got %v", expectedPaths, paths)
+	}
+}
+
+func Test_TransformError(t *testing.T) {
+	_, err := modconfigobj.Transform([]byte("[section]\nbroken\n"), func(key []string, value string) string {
+		return value
+	})
+	if err == nil {
+		t.Error("expected an error for a key without a value")
+	}
+}
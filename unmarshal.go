@@ -0,0 +1,264 @@
+package modconfigobj
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// UnmarshalError describes a key or section that could not be stored
+// in the struct field it maps to
+type UnmarshalError struct {
+	Position int64
+	Key      string
+	Err      error
+}
+
+func (e UnmarshalError) Error() string {
+	return fmt.Sprintf("cannot unmarshal %s at %d: %v", e.Key, e.Position, e.Err)
+}
+
+func (e UnmarshalError) Unwrap() error {
+	return e.Err
+}
+
+// Unmarshal lexes r and stores its keys in the struct pointed to by v.
+//
+// A key is stored in the field tagged `configobj:"name"` with the key's
+// name, or failing that the field whose name matches the key ignoring
+// case. A tag of "-" skips the field. Sections map onto fields of
+// struct (or pointer to struct) type in the same way, with their keys
+// and subsections stored in that struct. Keys and sections that don't
+// match a field are ignored, as are those of a section that skips a
+// level of nesting. Brackets in section names may be escaped with a
+// backslash, as written by EncodeSectionName.
+//
+// Fields may be strings, bools, ints, uints, floats, or slices of
+// those, which are read from a comma separated list. Quotes around a
+// value or list element are removed, and commas within a quoted list
+// element are part of the element. An empty value is read as a nil
+// slice. Integers are decimal, as Marshal writes them, so a leading
+// zero doesn't make one octal.
+//
+// An invalid token is reported as a LexError, and a value that doesn't
+// suit its field's type as an UnmarshalError.
+func Unmarshal(r io.Reader, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("Unmarshal expects a non-nil pointer to a struct, got %T", v)
+	}
+
+	lex := NewLexerFromReader(r)
+	lex.TrimValues = true
+	lex.SectionEscapes = true
+	lex.DecodeSectionEscapes = true
+
+	// sections[i] is the struct for the section at depth i, or an
+	// invalid Value if the section has no field to be stored in
+	sections := []reflect.Value{rv.Elem()}
+	var path []string
+	var key string
+	for {
+		t := lex.NextItem()
+		switch t.TokenType {
+		case ItemError:
+			return newLexError(t)
+		case ItemSection:
+			// a skipped level of nesting has no struct to store into
+			for len(sections) < t.Depth {
+				sections = append(sections, reflect.Value{})
+			}
+			sections = sections[:t.Depth]
+			path = lex.CurrentSection()
+
+			section, err := sectionField(sections[t.Depth-1], t.Name)
+			if err != nil {
+				return UnmarshalError{Position: t.Position, Key: strings.Join(path, "."), Err: err}
+			}
+			sections = append(sections, section)
+		case ItemKey:
+			key = unquote(strings.TrimSpace(t.Value))
+		case ItemValue:
+			section := sections[len(sections)-1]
+			if !section.IsValid() {
+				continue
+			}
+
+			field, ok := findField(section, key)
+			if !ok {
+				continue
+			}
+			if err := setField(field, t.Value); err != nil {
+				return UnmarshalError{Position: t.Position, Key: strings.Join(append(path, key), "."), Err: err}
+			}
+		case ItemEOF:
+			return nil
+		}
+	}
+}
+
+// sectionField finds the struct in which the keys of the section name
+// are stored, allocating it if the field is a nil pointer. An invalid
+// Value is returned if parent has no field for the section.
+func sectionField(parent reflect.Value, name string) (reflect.Value, error) {
+	if !parent.IsValid() {
+		return reflect.Value{}, nil
+	}
+
+	field, ok := findField(parent, name)
+	if !ok {
+		return reflect.Value{}, nil
+	}
+
+	if field.Kind() == reflect.Ptr && field.Type().Elem().Kind() == reflect.Struct {
+		if field.IsNil() {
+			field.Set(reflect.New(field.Type().Elem()))
+		}
+		field = field.Elem()
+	}
+	if field.Kind() != reflect.Struct {
+		return reflect.Value{}, fmt.Errorf("section cannot be stored in a field of type %s", field.Type())
+	}
+
+	return field, nil
+}
+
+// findField finds the field of the struct s that the key name maps to
+func findField(s reflect.Value, name string) (reflect.Value, bool) {
+	st := s.Type()
+
+	fallback := -1
+	for i := 0; i < st.NumField(); i++ {
+		f := st.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+
+		tag, _ := fieldTag(f)
+		switch {
+		case tag == "-":
+		case tag != "":
+			if tag == name {
+				return s.Field(i), true
+			}
+		case fallback < 0 && strings.EqualFold(f.Name, name):
+			fallback = i
+		}
+	}
+
+	if fallback < 0 {
+		return reflect.Value{}, false
+	}
+	return s.Field(fallback), true
+}
+
+// fieldTag splits the configobj tag of f into its name and options
+func fieldTag(f reflect.StructField) (name string, opts string) {
+	tag := f.Tag.Get("configobj")
+	if i := strings.Index(tag, ","); i >= 0 {
+		return tag[:i], tag[i+1:]
+	}
+	return tag, ""
+}
+
+// setField parses value according to the type of field and stores it
+func setField(field reflect.Value, value string) error {
+	if field.Kind() != reflect.Slice {
+		return setScalar(field, unquote(value))
+	}
+	if strings.TrimSpace(value) == "" {
+		// as written by Marshal for an empty slice
+		field.Set(reflect.Zero(field.Type()))
+		return nil
+	}
+
+	elems := splitList(value)
+	if last := len(elems) - 1; last > 0 && strings.TrimSpace(elems[last]) == "" {
+		// allow a trailing comma
+		elems = elems[:last]
+	}
+
+	slice := reflect.MakeSlice(field.Type(), len(elems), len(elems))
+	for i, elem := range elems {
+		if err := setScalar(slice.Index(i), unquote(strings.TrimSpace(elem))); err != nil {
+			return err
+		}
+	}
+	field.Set(slice)
+
+	return nil
+}
+
+// splitList splits the comma separated list value, ignoring commas
+// within an element that begins with a quote
+func splitList(value string) []string {
+	var elems []string
+	start := 0
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; {
+		case c == ',':
+			elems = append(elems, value[start:i])
+			start = i + 1
+		case (c == '"' || c == '\'') && strings.TrimSpace(value[start:i]) == "":
+			q := value[i : i+1]
+			if strings.HasPrefix(value[i:], q+q+q) {
+				q += q + q
+			}
+			// skip to the closing quote, leaving an unterminated
+			// quote to be split as though it weren't there
+			if end := strings.Index(value[i+len(q):], q); end >= 0 {
+				i += 2*len(q) + end - 1
+			}
+		}
+	}
+
+	return append(elems, value[start:])
+}
+
+func setScalar(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(value, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(value, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	default:
+		return fmt.Errorf("unsupported field type %s", field.Type())
+	}
+
+	return nil
+}
+
+// unquote removes a matching pair of single, double, or triple quotes
+// surrounding s
+func unquote(s string) string {
+	for _, q := range []string{`'''`, `"""`, `'`, `"`} {
+		if len(s) >= 2*len(q) && strings.HasPrefix(s, q) && strings.HasSuffix(s, q) {
+			return s[len(q) : len(s)-len(q)]
+		}
+	}
+	return s
+}
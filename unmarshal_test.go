@@ -0,0 +1,167 @@
+package modconfigobj_test
+
+import (
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/christian-blades-cb/modconfigobj"
+)
+
+type tlsConfig struct {
+	Cert    string   `configobj:"cert"`
+	Ciphers []string `configobj:"ciphers"`
+}
+
+type serverConfig struct {
+	Host    string  `configobj:"host"`
+	Port    uint16  `configobj:"port"`
+	Debug   bool    `configobj:"debug"`
+	Load    float64 `configobj:"load"`
+	Retries []int   `configobj:"retries"`
+	Motd    string  `configobj:"motd,omitempty"`
+	TLS     *tlsConfig
+	Skipped string `configobj:"-"`
+}
+
+type appConfig struct {
+	Name    string
+	Workers int          `configobj:"workers"`
+	Server  serverConfig `configobj:"server"`
+}
+
+func Test_Unmarshal(t *testing.T) {
+	const src = `
+name = "example"
+workers = 4
+unknown = ignored
+
+[server]
+host = localhost
+port = 8080
+debug = true
+load = 0.75
+retries = 1, 2, 3,
+skipped = never set
+
+  [[tls]]
+  cert = '/etc/ssl/cert.pem'
+  ciphers = ECDHE, "AES"
+
+[elsewhere]
+host = ignored
+`
+
+	var cfg appConfig
+	if err := modconfigobj.Unmarshal(strings.NewReader(src), &cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := appConfig{
+		Name:    "example",
+		Workers: 4,
+		Server: serverConfig{
+			Host:    "localhost",
+			Port:    8080,
+			Debug:   true,
+			Load:    0.75,
+			Retries: []int{1, 2, 3},
+			TLS: &tlsConfig{
+				Cert:    "/etc/ssl/cert.pem",
+				Ciphers: []string{"ECDHE", "AES"},
+			},
+		},
+	}
+	if !reflect.DeepEqual(cfg, expected) {
+		t.Errorf("expected %+v, got %+v", expected, cfg)
+	}
+}
+
+func Test_UnmarshalTypeMismatch(t *testing.T) {
+	const src = "[server]\nport = eighty\n"
+
+	var cfg appConfig
+	err := modconfigobj.Unmarshal(strings.NewReader(src), &cfg)
+
+	var uerr modconfigobj.UnmarshalError
+	if !errors.As(err, &uerr) {
+		t.Fatalf("expected an UnmarshalError, got %v", err)
+	}
+	if uerr.Key != "server.port" || uerr.Position != 16 || !errors.Is(err, strconv.ErrSyntax) {
+		t.Errorf("unexpected error %#v", uerr)
+	}
+}
+
+func Test_UnmarshalDecimal(t *testing.T) {
+	var cfg struct {
+		Signed   int    `configobj:"signed"`
+		Unsigned uint   `configobj:"unsigned"`
+		Leading  []int  `configobj:"leading"`
+		Eights   []uint `configobj:"eights"`
+	}
+
+	const src = "signed = 010\nunsigned = 010\nleading = 08, -09\neights = 08, 0088\n"
+	if err := modconfigobj.Unmarshal(strings.NewReader(src), &cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Signed != 10 || cfg.Unsigned != 10 {
+		t.Errorf("expected 010 to read as 10, got %d and %d", cfg.Signed, cfg.Unsigned)
+	}
+	if expected := []int{8, -9}; !reflect.DeepEqual(cfg.Leading, expected) {
+		t.Errorf("expected %v, got %v", expected, cfg.Leading)
+	}
+	if expected := []uint{8, 88}; !reflect.DeepEqual(cfg.Eights, expected) {
+		t.Errorf("expected %v, got %v", expected, cfg.Eights)
+	}
+}
+
+func Test_UnmarshalSkippedLevel(t *testing.T) {
+	const src = "workers = 1\n[server]\n[[[tls]]]\ncert = skipped.pem\n[[tls]]\ncert = used.pem\n"
+
+	var cfg appConfig
+	if err := modconfigobj.Unmarshal(strings.NewReader(src), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Workers != 1 || cfg.Server.TLS == nil || cfg.Server.TLS.Cert != "used.pem" {
+		t.Errorf("unexpected config %+v", cfg)
+	}
+}
+
+func Test_UnmarshalErrors(t *testing.T) {
+	var cfg appConfig
+	for _, c := range []struct {
+		src string
+		v   interface{}
+	}{
+		{"key = value\n", cfg},
+		{"key = value\n", (*appConfig)(nil)},
+		{"[workers]\n", &cfg},
+		{"[broken\n", &cfg},
+	} {
+		if err := modconfigobj.Unmarshal(strings.NewReader(c.src), c.v); err == nil {
+			t.Errorf("%q into %T: expected an error", c.src, c.v)
+		}
+	}
+}
+
+func Test_UnmarshalQuotedList(t *testing.T) {
+	var cfg struct {
+		Query []string `configobj:"query"`
+		Tags  []string `configobj:"tags"`
+	}
+
+	const src = "query = \"a=1\", \"b,c\"\ntags = '''x, y''', it's, \"\"\n"
+	if err := modconfigobj.Unmarshal(strings.NewReader(src), &cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := []string{"a=1", "b,c"}; !reflect.DeepEqual(cfg.Query, expected) {
+		t.Errorf("expected query %q, got %q", expected, cfg.Query)
+	}
+	if expected := []string{"x, y", "it's", ""}; !reflect.DeepEqual(cfg.Tags, expected) {
+		t.Errorf("expected tags %q, got %q", expected, cfg.Tags)
+	}
+}
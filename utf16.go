@@ -0,0 +1,81 @@
+package modconfigobj
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// NewLexerUTF16 initializes a Lexer for UTF-16 encoded input, which is
+// transcoded as it's read. A leading byte order mark selects the byte
+// order and is skipped; without one the input is taken to be
+// little-endian, as Windows writes it. Positions and lengths are those
+// of the UTF-8 form of the input, so in-place edits apply to that form
+// rather than to the original bytes.
+func NewLexerUTF16(r io.Reader) *Lexer {
+	return NewLexer(&utf16Reader{r: bufio.NewReader(r)})
+}
+
+// utf16Reader decodes UTF-16 into runes, reporting the size of each as
+// its UTF-8 length
+type utf16Reader struct {
+	r     *bufio.Reader
+	order binary.ByteOrder
+
+	last     rune
+	lastSize int
+	unread   bool
+}
+
+func (u *utf16Reader) ReadRune() (rune, int, error) {
+	if u.unread {
+		u.unread = false
+		return u.last, u.lastSize, nil
+	}
+
+	if u.order == nil {
+		u.order = binary.LittleEndian
+		if bom, err := u.r.Peek(2); err == nil {
+			switch {
+			case bom[0] == 0xff && bom[1] == 0xfe:
+				u.r.Discard(2)
+			case bom[0] == 0xfe && bom[1] == 0xff:
+				u.order = binary.BigEndian
+				u.r.Discard(2)
+			}
+		}
+	}
+
+	var unit [2]byte
+	if _, err := io.ReadFull(u.r, unit[:]); err != nil {
+		u.lastSize = 0
+		return 0, 0, err
+	}
+
+	r := rune(u.order.Uint16(unit[:]))
+	if utf16.IsSurrogate(r) {
+		// an unpaired surrogate is replaced, leaving the unit that
+		// follows it to be read on its own
+		low, err := u.r.Peek(2)
+		if err != nil {
+			r = unicode.ReplacementChar
+		} else if r = utf16.DecodeRune(r, rune(u.order.Uint16(low))); r != unicode.ReplacementChar {
+			u.r.Discard(2)
+		}
+	}
+
+	u.last, u.lastSize = r, utf8.RuneLen(r)
+	return u.last, u.lastSize, nil
+}
+
+func (u *utf16Reader) UnreadRune() error {
+	if u.unread || u.lastSize == 0 {
+		return bufio.ErrInvalidUnreadRune
+	}
+
+	u.unread = true
+	return nil
+}
@@ -0,0 +1,67 @@
+package modconfigobj_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/christian-blades-cb/modconfigobj"
+)
+
+// encodeUTF16 encodes s as UTF-16 in the given byte order, following
+// a byte order mark if bom is set
+func encodeUTF16(s string, order binary.ByteOrder, bom bool) []byte {
+	units := utf16.Encode([]rune(s))
+	if bom {
+		units = append([]uint16{0xfeff}, units...)
+	}
+
+	out := make([]byte, 2*len(units))
+	for i, unit := range units {
+		order.PutUint16(out[2*i:], unit)
+	}
+	return out
+}
+
+func Test_NewLexerUTF16(t *testing.T) {
+	const src = "[sección]\nkey = välue 🙂\n# ok\n"
+	expected := lexAll(src)
+
+	for _, c := range []struct {
+		name  string
+		order binary.ByteOrder
+		bom   bool
+	}{
+		{"little-endian", binary.LittleEndian, true},
+		{"big-endian", binary.BigEndian, true},
+		{"no BOM", binary.LittleEndian, false},
+	} {
+		lex := modconfigobj.NewLexerUTF16(bytes.NewReader(encodeUTF16(src, c.order, c.bom)))
+
+		var got []modconfigobj.Token
+		for tok := lex.NextItem(); ; tok = lex.NextItem() {
+			got = append(got, tok)
+			if tok.IsEOF() {
+				break
+			}
+		}
+
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("%s: expected %v, got %v", c.name, expected, got)
+		}
+	}
+}
+
+func Test_NewLexerUTF16OddLength(t *testing.T) {
+	input := append(encodeUTF16("key = value", binary.LittleEndian, true), 'x')
+
+	lex := modconfigobj.NewLexerUTF16(bytes.NewReader(input))
+	for tok := lex.NextItem(); !tok.IsEOF(); tok = lex.NextItem() {
+		if tok.IsError() {
+			return
+		}
+	}
+	t.Error("expected an error for a truncated code unit")
+}
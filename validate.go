@@ -0,0 +1,81 @@
+package modconfigobj
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// LexError describes an invalid token encountered while lexing.
+// Context and Column locate the error within its line, and Filename
+// and Line name the file and line, as for Token. Err is the read
+// error behind the token when the input could not be read.
+type LexError struct {
+	Position int64
+	Len      int64
+	Message  string
+	Context  string
+	Column   int
+	Filename string
+	Line     int
+	Err      error
+}
+
+// newLexError describes the ItemError t
+func newLexError(t Token) LexError {
+	return LexError{
+		Position: t.Position,
+		Len:      t.Len,
+		Message:  t.Message,
+		Context:  t.Context,
+		Column:   t.Column,
+		Filename: t.Filename,
+		Line:     t.Line,
+		Err:      t.err,
+	}
+}
+
+// Error describes the error and its position, followed by a snippet
+// of the line it occurred on if the line is known. The position is
+// given as "filename:line:col" when Filename is set.
+func (e LexError) Error() string {
+	if e.Filename != "" {
+		return fmt.Sprintf("%s:%d:%d: %s", e.Filename, e.Line, e.Column+1, e.Message) + snippet(e.Context, e.Column)
+	}
+	return fmt.Sprintf("%s at %d", e.Message, e.Position) + snippet(e.Context, e.Column)
+}
+
+func (e LexError) Unwrap() error {
+	return e.Err
+}
+
+// LexErrors is a list of LexError, such as the errors skipped by
+// Lexer.NextValid
+type LexErrors []LexError
+
+// Error describes each error on a line of its own
+func (e LexErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Validate lexes the entirety of r and reports every error found,
+// rather than stopping at the first one. The lexer resumes on the line
+// following each error, so a malformed line yields a single error.
+func Validate(r io.Reader) []LexError {
+	var errs []LexError
+
+	lex := NewLexerFromReader(r)
+	for {
+		t := lex.NextItem()
+		switch t.TokenType {
+		case ItemError:
+			errs = append(errs, newLexError(t))
+		case ItemEOF:
+			return errs
+		}
+	}
+}
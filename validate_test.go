@@ -0,0 +1,56 @@
+package modconfigobj_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/christian-blades-cb/modconfigobj"
+)
+
+func Test_Validate(t *testing.T) {
+	const src = `[ok]
+key = value
+=nokey
+bare
+[broken
+quoted = ""x"
+good = value
+`
+
+	expected := []modconfigobj.LexError{
+		{Position: int64(strings.Index(src, "=nokey")), Message: "missing key before '='"},
+		{Position: int64(strings.Index(src, "bare")), Message: "missing '=' after key"},
+		{Position: int64(strings.Index(src, "[broken")), Message: "unterminated section header"},
+		{Position: int64(strings.Index(src, `""x"`)), Message: "mismatched quotes"},
+	}
+
+	errs := modconfigobj.Validate(strings.NewReader(src))
+	if len(errs) != len(expected) {
+		t.Fatalf("expected %d errors, got %d: %v", len(expected), len(errs), errs)
+	}
+	for i, e := range expected {
+		if errs[i].Position != e.Position || errs[i].Message != e.Message {
+			t.Errorf("error %d: expected %q at %d, got %q at %d", i, e.Message, e.Position, errs[i].Message, errs[i].Position)
+		}
+	}
+}
+
+func Test_ValidateCleanFile(t *testing.T) {
+	if errs := modconfigobj.Validate(strings.NewReader(SimpleFile)); len(errs) != 0 {
+		t.Errorf("expected no errors, got %v", errs)
+	}
+}
+
+func Test_LexErrorContext(t *testing.T) {
+	const src = "[ok]\n\tkey = 'open\n"
+
+	errs := modconfigobj.Validate(strings.NewReader(src))
+	if len(errs) != 1 {
+		t.Fatalf("expected 1 error, got %v", errs)
+	}
+
+	const expected = "unterminated quoted value at 12\n\t\tkey = 'open\n\t\t      ^"
+	if msg := errs[0].Error(); msg != expected {
+		t.Errorf("expected %q, got %q", expected, msg)
+	}
+}